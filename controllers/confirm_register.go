@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/emmadal/feeti-auth/helpers"
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/emmadal/feeti-auth/walletclient"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+)
+
+// ConfirmRegister verifies the phone number with the OTP and creates the user and its wallet
+func ConfirmRegister(c *gin.Context) {
+	// Increment counter for HTTP requests total to prometheus
+	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
+
+	var body models.ConfirmRegistration
+
+	// Validate the request body
+	if err := c.ShouldBindJSON(&body); err != nil {
+		status.HandleError(c, http.StatusBadRequest, "Invalid request data", err)
+		return
+	}
+
+	keyUID, err := uuid.Parse(body.KeyUID)
+	if err != nil {
+		status.HandleError(c, http.StatusBadRequest, "Invalid request data", err)
+		return
+	}
+
+	// Verify and consume the OTP
+	if err := helpers.CheckOTP(keyUID, body.PhoneNumber, models.OTPPurposeRegister, body.CodeOTP); err != nil {
+		handleOTPError(c, err)
+		return
+	}
+
+	// Load the pending registration
+	pending, err := models.GetPendingRegistration(keyUID, body.PhoneNumber)
+	if err != nil {
+		if errors.Is(err, models.ErrPendingRegistrationNotFound) {
+			status.HandleError(c, http.StatusGone, "Registration expired. Please register again", err)
+			return
+		}
+		status.HandleError(c, http.StatusInternalServerError, "Unable to process registration", err)
+		return
+	}
+
+	// Another registration may have been confirmed for this number in the meantime
+	existing := models.User{PhoneNumber: pending.PhoneNumber}
+	if existing.CheckUserByPhone() {
+		status.HandleError(c, http.StatusConflict, "User already exist", nil)
+		return
+	}
+
+	// Create the user and start the registration saga
+	saga, user, err := helpers.StartRegistration(pending)
+	if err != nil {
+		status.HandleError(c, http.StatusUnprocessableEntity, "Unable to process user", err)
+		return
+	}
+
+	// Create the wallet. Only a rejection undoes the registration: a slow wallet service may still create
+	// the wallet, so the saga is left pending for the reconciler to retry or roll back.
+	wallet, err := helpers.RequestWallet(saga)
+	if err != nil {
+		if !errors.Is(err, walletclient.ErrRejected) {
+			log.Printf("Registration saga %s left to the reconciler: %v\n", saga.ID, err)
+			c.SecureJSON(
+				http.StatusAccepted, gin.H{
+					"message": "Registration is being completed. Please sign in in a few minutes",
+					"success": true,
+				},
+			)
+			return
+		}
+		if err := helpers.CompensateRegistration(saga, err); err != nil {
+			log.Printf("Error compensating registration saga %s: %v\n", saga.ID, err)
+		}
+		status.HandleError(c, http.StatusUnprocessableEntity, "Unable to request wallet creation", err)
+		return
+	}
+
+	// Generate tokens and set cookies
+	refreshToken, sessionID, err := issueSessionTokens(c, user.ID, user.DeviceToken, false)
+	if err != nil {
+		if err := helpers.CompensateRegistration(saga, err); err != nil {
+			log.Printf("Error compensating registration saga %s: %v\n", saga.ID, err)
+		}
+		status.HandleError(c, http.StatusInternalServerError, "Unable to generate token", err)
+		return
+	}
+	if err := helpers.SessionIssued(saga, sessionID); err != nil {
+		log.Printf("Error recording registration saga %s session: %v\n", saga.ID, err)
+	}
+
+	// The reconciler completes the saga when this fails
+	if err := helpers.CompleteRegistration(saga, user); err != nil {
+		log.Printf("Error completing registration saga %s: %v\n", saga.ID, err)
+	}
+
+	// record auth log
+	go func() {
+		authLog := models.AuthLog{
+			UserID:      user.ID,
+			PhoneNumber: user.PhoneNumber,
+			DeviceToken: user.DeviceToken,
+			Activity:    "register",
+			Metadata:    `{"source": "register"}`,
+		}
+		if err := authLog.CreateAuthLog(); err != nil {
+			log.Printf("Error creating auth log: %v\n", err)
+		}
+	}()
+
+	// Send success response
+	status.HandleSuccessData(
+		c, "User registered successfully", models.AuthResponse{
+			User: models.UserResponse{
+				ID:          user.ID,
+				PhoneNumber: user.PhoneNumber,
+				FirstName:   user.FirstName,
+				LastName:    user.LastName,
+				Photo:       user.Photo,
+				DeviceToken: user.DeviceToken,
+			},
+			Wallet:       wallet,
+			RefreshToken: refreshToken,
+		},
+	)
+}
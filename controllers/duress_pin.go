@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/emmadal/feeti-auth/helpers"
+	"github.com/emmadal/feeti-auth/models"
+	jwt "github.com/emmadal/feeti-module/auth"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+)
+
+// SetDuressPin sets or replaces the duress PIN of the user.
+// From a session opened with the duress PIN, it answers the same without changing anything.
+func SetDuressPin(c *gin.Context) {
+	// Increment counter for HTTP requests total to prometheus
+	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
+
+	var body models.SetDuressPin
+
+	// Validate the request body
+	if err := c.ShouldBindJSON(&body); err != nil {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", err)
+		return
+	}
+
+	policy := helpers.GetPinPolicy()
+	if !policy.ValidPin(body.Pin) {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", nil)
+		return
+	}
+
+	user, ok := duressPinUser(c, body.Pin)
+	if !ok {
+		return
+	}
+
+	// The duress PIN follows the PIN policy and must differ from the PIN
+	if err := policy.Check(body.DuressPin); err != nil {
+		handlePinPolicyError(c, err)
+		return
+	}
+	same, _, err := helpers.VerifyPassword(c.Request.Context(), body.DuressPin, sessionPinHash(c, user))
+	if err != nil {
+		handleHashingError(c, "Failed to set duress PIN", err)
+		return
+	}
+	if same {
+		handlePinPolicyError(c, &helpers.PinPolicyError{Reasons: []string{helpers.PinReasonDuress}, Length: policy.Length})
+		return
+	}
+
+	if !helpers.IsDuressSession(c) {
+		hashedPin, err := helpers.HashPassword(c.Request.Context(), body.DuressPin)
+		if err != nil {
+			handleHashingError(c, "Failed to set duress PIN", err)
+			return
+		}
+		user.DuressPin = &hashedPin
+		if err := user.UpdateDuressPin(); err != nil {
+			status.HandleError(c, http.StatusInternalServerError, "Failed to set duress PIN", err)
+			return
+		}
+	}
+	recordDuressPinChange(c, user, "set_duress_pin")
+
+	// Return success
+	status.HandleSuccess(c, "Your duress PIN has been set")
+}
+
+// RemoveDuressPin removes the duress PIN of the user.
+// From a session opened with the duress PIN, it answers the same without changing anything.
+func RemoveDuressPin(c *gin.Context) {
+	// Increment counter for HTTP requests total to prometheus
+	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
+
+	var body models.RemoveDuressPin
+
+	// Validate the request body
+	if err := c.ShouldBindJSON(&body); err != nil {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", err)
+		return
+	}
+
+	if !helpers.GetPinPolicy().ValidPin(body.Pin) {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", nil)
+		return
+	}
+
+	user, ok := duressPinUser(c, body.Pin)
+	if !ok {
+		return
+	}
+
+	if !helpers.IsDuressSession(c) && user.DuressPin != nil {
+		user.DuressPin = nil
+		if err := user.UpdateDuressPin(); err != nil {
+			status.HandleError(c, http.StatusInternalServerError, "Failed to remove duress PIN", err)
+			return
+		}
+	}
+	recordDuressPinChange(c, user, "remove_duress_pin")
+
+	// Return success
+	status.HandleSuccess(c, "Your duress PIN has been removed")
+}
+
+// duressPinUser fetches the signed in user and checks its PIN, responding on failure
+func duressPinUser(c *gin.Context, pin string) (*models.User, bool) {
+	user, err := models.GetUserByID(jwt.GetUserIDFromGin(c))
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			status.HandleError(c, http.StatusUnauthorized, "Unauthorized user", err)
+			return nil, false
+		}
+		status.HandleError(c, http.StatusInternalServerError, "Something went wrong while checking user data", err)
+		return nil, false
+	}
+
+	match, _, err := helpers.VerifyPassword(c.Request.Context(), pin, sessionPinHash(c, user))
+	if err != nil {
+		handleHashingError(c, "Something went wrong while checking user data", err)
+		return nil, false
+	}
+	if !match {
+		status.HandleError(c, http.StatusUnauthorized, "Invalid PIN", nil)
+		return nil, false
+	}
+	return user, true
+}
+
+// sessionPinHash returns the hash of the PIN the session was opened with. Under duress, that is the duress PIN,
+// so that PIN checks answer as if it were the PIN of the user.
+func sessionPinHash(c *gin.Context, user *models.User) string {
+	if !helpers.IsDuressSession(c) {
+		return user.Pin
+	}
+	if user.DuressPin == nil {
+		return ""
+	}
+	return *user.DuressPin
+}
+
+// recordDuressPinChange records a change of the duress PIN in the internal auth logs
+func recordDuressPinChange(c *gin.Context, user *models.User, activity string) {
+	metadata := `{"source": "` + activity + `", "duress": false}`
+	if helpers.IsDuressSession(c) {
+		metadata = `{"source": "` + activity + `", "duress": true}`
+	}
+	go func() {
+		authLog := models.AuthLog{
+			UserID:      user.ID,
+			PhoneNumber: user.PhoneNumber,
+			DeviceToken: user.DeviceToken,
+			Activity:    activity,
+			Metadata:    metadata,
+			Internal:    true,
+		}
+		if err := authLog.CreateAuthLog(); err != nil {
+			log.Printf("Error creating auth log: %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/emmadal/feeti-auth/helpers"
+	"github.com/emmadal/feeti-auth/models"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	MaxResetPinRequests = 3
+	ResetPinWindow      = time.Hour
+)
+
+// ForgotPin sends a PIN reset code to the user's phone number.
+// An unknown number gets the same response, with a code that is never sent.
+func ForgotPin(c *gin.Context) {
+	// Increment counter for HTTP requests total to prometheus
+	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
+
+	body := models.ForgotPin{}
+
+	// Validate the request body
+	if err := c.ShouldBindJSON(&body); err != nil {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", err)
+		return
+	}
+
+	// Rate limit reset codes per phone number, known or not
+	count, err := models.CountOTPs(body.PhoneNumber, models.OTPPurposeResetPin, time.Now().Add(-ResetPinWindow))
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+		return
+	}
+	if count >= MaxResetPinRequests {
+		status.HandleError(c, http.StatusTooManyRequests, "Too many verification codes requested. Please try again later", nil)
+		return
+	}
+
+	// Fetch user
+	user, err := models.GetUserByPhoneNumber(body.PhoneNumber)
+	if err != nil {
+		if !errors.Is(err, models.ErrUserNotFound) {
+			status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+			return
+		}
+		// Answer an unknown number like a known one
+		decoy, err := helpers.IssueDecoyOTP(body.PhoneNumber, models.OTPPurposeResetPin)
+		if err != nil {
+			status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+			return
+		}
+		sendResetPinCode(c, decoy)
+		return
+	}
+
+	// Issue and send the OTP
+	otp, err := helpers.IssueOTP(user.PhoneNumber, models.OTPPurposeResetPin)
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+		return
+	}
+
+	// record auth log
+	go func() {
+		authLog := models.AuthLog{
+			UserID:      user.ID,
+			PhoneNumber: user.PhoneNumber,
+			DeviceToken: user.DeviceToken,
+			Activity:    "forgot_pin",
+			Metadata:    `{"source": "forgot_pin"}`,
+		}
+		if err := authLog.CreateAuthLog(); err != nil {
+			log.Printf("Error creating auth log: %v\n", err)
+		}
+	}()
+
+	sendResetPinCode(c, otp)
+}
+
+// sendResetPinCode answers with the key UID of the reset code
+func sendResetPinCode(c *gin.Context, otp *models.OTP) {
+	status.HandleSuccessData(
+		c, "Verification code sent", gin.H{
+			"key_uid":    otp.KeyUID,
+			"expires_at": otp.ExpiresAt,
+		},
+	)
+}
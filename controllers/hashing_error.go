@@ -0,0 +1,20 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emmadal/feeti-auth/helpers"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+)
+
+// handleHashingError answers 503 when the hashing pool is busy, and 500 with message otherwise
+func handleHashingError(c *gin.Context, message string, err error) {
+	if errors.Is(err, helpers.ErrHashingBusy) {
+		c.Header("Retry-After", "1")
+		status.HandleError(c, http.StatusServiceUnavailable, "Service busy. Please try again", err)
+		return
+	}
+	status.HandleError(c, http.StatusInternalServerError, message, err)
+}
@@ -15,9 +15,10 @@ func HealthCheck(c *gin.Context) {
 	// Return success response
 	status.HandleSuccessData(
 		c, "OK", gin.H{
-			"status":  "up",
-			"time":    time.Now().Format(time.RFC3339),
-			"service": "Auth Service",
+			"status":         "up",
+			"time":           time.Now().Format(time.RFC3339),
+			"service":        "Auth Service",
+			"wallet_breaker": helpers.WalletBreakerStatus(),
 		},
 	)
 }
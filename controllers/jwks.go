@@ -0,0 +1,17 @@
+package controllers
+
+import (
+	"github.com/emmadal/feeti-auth/helpers"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// JWKS serves the public keys that verify access tokens
+func JWKS(c *gin.Context) {
+	// Increment counter for HTTP requests total to prometheus
+	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
+
+	// Let verifiers cache the keys for less than the pre-publication window of a new key
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, helpers.JWKS())
+}
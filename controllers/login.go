@@ -1,25 +1,28 @@
 package controllers
 
 import (
-	"encoding/json"
-	"fmt"
-	jwt "github.com/emmadal/feeti-module/auth"
+	"errors"
 	status "github.com/emmadal/feeti-module/status"
-	"github.com/emmadal/feeti-module/subject"
-	"github.com/google/uuid"
 	"log"
-
-	"golang.org/x/sync/errgroup"
 	"net/http"
-	"os"
+	"strconv"
+	"time"
 
 	"github.com/emmadal/feeti-auth/helpers"
 	"github.com/emmadal/feeti-auth/models"
+	"github.com/emmadal/feeti-auth/walletclient"
 	"github.com/gin-gonic/gin"
-	"github.com/nats-io/nats.go"
+	"github.com/google/uuid"
+)
+
+const (
+	MaxLoginChallenges   = 3
+	LoginChallengeWindow = time.Hour
 )
 
-const MaxLoginAttempts = 3
+// InvalidCredentialsMessage is the answer to an unknown phone number or a wrong PIN,
+// so that responses do not tell whether a number has an account
+const InvalidCredentialsMessage = "phone number or pin incorrect"
 
 // Login handler to sign in a user
 func Login(c *gin.Context) {
@@ -27,8 +30,6 @@ func Login(c *gin.Context) {
 	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
 
 	var body models.UserLogin
-	var response helpers.ResponsePayload
-	natsMsg := make(chan *nats.Msg, 1)
 
 	// Validate the request body
 	if err := c.ShouldBindJSON(&body); err != nil {
@@ -36,117 +37,73 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	// Otherwise, fetch user and wallet from a database
-	userStruct := &models.User{PhoneNumber: body.PhoneNumber}
-	user, err := userStruct.GetUserByPhone()
-	if err != nil {
-		status.HandleError(c, http.StatusNotFound, "request not found", err)
+	// PINs may have the policy length or the legacy one
+	pinPolicy := helpers.GetPinPolicy()
+	if !pinPolicy.ValidPin(body.Pin) {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", nil)
 		return
 	}
 
-	// Check if the user is locked and the quota exceeded
-	if user.Locked && user.Quota >= MaxLoginAttempts {
-		status.HandleError(c, http.StatusLocked, "Your account has been locked. Please contact support", nil)
+	// Reject clients caught trying PINs across many accounts
+	source := helpers.NewStuffingSource(c, body.DeviceToken)
+	verdict, retryAfter := helpers.Stuffing().Check(source)
+	if verdict == helpers.StuffingBlock {
+		helpers.StuffingChallengesTotal.WithLabelValues(verdict.String()).Inc()
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		status.HandleError(c, http.StatusTooManyRequests, "Too many failed attempts. Please try again later", nil)
 		return
 	}
 
-	// Lock the account if the quota exceeds the limit
-	if user.Quota == MaxLoginAttempts && !user.Locked {
-		// lock user and wallet concurrently
-		group := errgroup.Group{}
-		group.Go(
-			func() error {
-				if err := user.LockUser(); err != nil {
-					return err
-				}
-				return nil
-			},
-		)
-
-		group.Go(
-			func() error {
-				// send a nats message to lock wallet
-				pMessage := helpers.RequestPayload{
-					Subject: subject.SubjectWalletLock,
-					Data:    fmt.Sprintf("%d", userStruct.ID),
-				}
-				resp, err := pMessage.PublishEvent()
-				if err != nil {
-					return err
-				}
-				natsMsg <- resp
-				return nil
-			},
-		)
-
-		if err := group.Wait(); err != nil {
-			status.HandleError(c, http.StatusInternalServerError, "Unable to lock user and wallet", err)
-			return
-		}
-		result := <-natsMsg
-		_ = json.Unmarshal(result.Data, &response)
-		if response.Success && response.Data == nil {
-			status.HandleError(
-				c, http.StatusLocked, "Maximum login attempts reached. Your account has been locked", nil,
-			)
-			return
-		}
-		status.HandleError(c, http.StatusInternalServerError, "Something went wrong while locking user data", nil)
+	// Otherwise, fetch user and wallet from a database
+	userStruct := &models.User{PhoneNumber: body.PhoneNumber}
+	user, err := userStruct.GetUserByPhone()
+	if err != nil && !errors.Is(err, models.ErrUserNotFound) {
+		status.HandleError(c, http.StatusInternalServerError, "Something went wrong while checking user data", err)
 		return
 	}
 
-	// Verify the PIN and increment quota
-	if !helpers.VerifyPassword(body.Pin, user.Pin) {
-		if user.Quota < MaxLoginAttempts {
-			if err := user.UpdateUserQuota(); err != nil {
-				status.HandleError(c, http.StatusInternalServerError, "Failed to update user quota", err)
-				return
-			}
-		}
-		// Return error
-		status.HandleError(c, http.StatusUnauthorized, "phone number or pin incorrect", nil)
+	// A suspicious client must confirm a code sent to the phone number before the PIN is checked,
+	// so that the challenge tells neither whether the PIN is right nor whether the number has an account
+	if verdict == helpers.StuffingStepUp && !confirmLoginChallenge(c, body, user) {
 		return
 	}
 
-	// publish a request to get wallet data
-	pMessage := helpers.RequestPayload{
-		Subject: subject.SubjectWalletBalance,
-		Data:    user.ID.String(),
-	}
-	resp, err := pMessage.PublishEvent()
-	if err != nil {
-		status.HandleError(c, http.StatusUnprocessableEntity, "Unable to process wallet", err)
+	if user == nil {
+		// Answer an unknown phone number like a wrong PIN, in about the same time
+		if err := helpers.VerifyDummyPassword(c.Request.Context(), body.Pin); err != nil {
+			handleHashingError(c, "Something went wrong while checking user data", err)
+			return
+		}
+		helpers.Stuffing().RecordFailure(source, body.PhoneNumber, uuid.Nil)
+		status.HandleError(c, http.StatusUnauthorized, InvalidCredentialsMessage, err)
 		return
 	}
 
-	// Unmarshal the wallet data
-	_ = json.Unmarshal(resp.Data, &response)
-	if !response.Success {
-		status.HandleError(c, http.StatusUnprocessableEntity, response.Error, nil)
+	// Verify the PIN under the lockout policy. The duress PIN signs in like the PIN.
+	duress, err := helpers.CheckUserPin(c.Request.Context(), user, body.Pin, c.ClientIP(), "login")
+	if err != nil {
+		if errors.Is(err, helpers.ErrInvalidPin) || errors.Is(err, helpers.ErrMaxAttemptsReached) {
+			helpers.Stuffing().RecordFailure(source, user.PhoneNumber, user.ID)
+		}
+		handlePinError(c, body.Pin, err)
 		return
 	}
 
-	// Convert response.Data from map[string]interface{} to models.Wallet
-	walletData := response.Data.(map[string]any)
-	wallet := models.Wallet{
-		ID:       uuid.MustParse(walletData["id"].(string)),
-		Balance:  walletData["balance"].(float64),
-		Currency: walletData["currency"].(string),
+	// Fetch the wallet with its balance. A wallet outage does not prevent signing in.
+	// Under duress the wallet returns the restricted balance, in a response of the same shape.
+	balance := helpers.WalletClient().Balance
+	if duress {
+		balance = helpers.WalletClient().RestrictedBalance
 	}
-
-	//Generate JWT token
-	token, err := jwt.GenerateToken(user.ID, []byte(os.Getenv("JWT_KEY")))
+	wallet, err := balance(c.Request.Context(), user.ID)
 	if err != nil {
-		status.HandleError(c, http.StatusInternalServerError, "Unable to generate token", err)
-		return
-	}
-
-	// Reset user quota if needed to update database
-	if user.Quota > 0 {
-		if err := user.ResetUserQuota(); err != nil {
-			status.HandleError(c, http.StatusInternalServerError, "Unable to reset quota", err)
+		if errors.Is(err, walletclient.ErrRejected) {
+			handleWalletError(c, err)
 			return
 		}
+		log.Printf("Login of user %s without wallet: %v\n", user.ID, err)
+		helpers.DegradedLoginsTotal.Inc()
+		wallet = &models.Wallet{Status: models.WalletUnavailable}
 	}
 
 	// Update device token only if changed
@@ -158,8 +115,21 @@ func Login(c *gin.Context) {
 		}
 	}
 
-	// Set cookie
-	jwt.SetSecureCookie(c, token, os.Getenv("DOMAIN"))
+	// Generate tokens and set cookies
+	refreshToken, sessionID, err := issueSessionTokens(c, user.ID, user.DeviceToken, duress)
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to generate token", err)
+		return
+	}
+	if duress {
+		helpers.RecordDuress(user, sessionID, c.ClientIP(), "login")
+	}
+
+	helpers.EmitUserEvent(helpers.UserLoggedIn{
+		UserID:      user.ID,
+		DeviceToken: user.DeviceToken,
+		IPAddress:   c.ClientIP(),
+	})
 
 	// record auth log
 	go func() {
@@ -175,6 +145,12 @@ func Login(c *gin.Context) {
 		}
 	}()
 
+	// During a PIN length migration, ask users with a PIN of the previous length to choose a new one
+	var pinUpgrade *models.PinUpgrade
+	if pinPolicy.NeedsUpgrade(user) {
+		pinUpgrade = &models.PinUpgrade{Required: true, Length: pinPolicy.Length}
+	}
+
 	// Return success response
 	status.HandleSuccessData(
 		c, "Login successfully", models.AuthResponse{
@@ -186,7 +162,79 @@ func Login(c *gin.Context) {
 				Photo:       user.Photo,
 				DeviceToken: user.DeviceToken,
 			},
-			Wallet: wallet,
+			Wallet:       wallet,
+			RefreshToken: refreshToken,
+			PinUpgrade:   pinUpgrade,
+		},
+	)
+}
+
+// confirmLoginChallenge verifies the login code of a step-up challenge, or sends one and responds with the challenge.
+// An unknown phone number, with a nil user, gets a challenge whose code is never sent.
+// It reports whether the login can go on.
+func confirmLoginChallenge(c *gin.Context, body models.UserLogin, user *models.User) bool {
+	if body.CodeOTP != "" && body.KeyUID != "" {
+		keyUID, err := uuid.Parse(body.KeyUID)
+		if err != nil {
+			status.HandleError(c, http.StatusBadRequest, "Bad request", err)
+			return false
+		}
+		if err := helpers.CheckOTP(keyUID, body.PhoneNumber, models.OTPPurposeLogin, body.CodeOTP); err != nil {
+			handleOTPError(c, err)
+			return false
+		}
+		return true
+	}
+
+	// Rate limit login codes per phone number
+	count, err := models.CountOTPs(body.PhoneNumber, models.OTPPurposeLogin, time.Now().Add(-LoginChallengeWindow))
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+		return false
+	}
+	if count >= MaxLoginChallenges {
+		status.HandleError(c, http.StatusTooManyRequests, "Too many verification codes requested. Please try again later", nil)
+		return false
+	}
+
+	issue := helpers.IssueOTP
+	if user == nil {
+		issue = helpers.IssueDecoyOTP
+	}
+	otp, err := issue(body.PhoneNumber, models.OTPPurposeLogin)
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+		return false
+	}
+	helpers.StuffingChallengesTotal.WithLabelValues(helpers.StuffingStepUp.String()).Inc()
+
+	c.SecureJSON(
+		http.StatusForbidden, gin.H{
+			"message": "Additional verification required. Please enter the code sent to your phone",
+			"success": false,
+			"data": gin.H{
+				"challenge":  "otp",
+				"key_uid":    otp.KeyUID,
+				"expires_at": otp.ExpiresAt,
+			},
 		},
 	)
+	return false
+}
+
+// handlePinError maps a PIN check error to an HTTP response. A locked or throttled account gets the 401 of a wrong PIN,
+// since unknown phone numbers have neither. Its PIN was not checked, so a throwaway one is, to take as long.
+func handlePinError(c *gin.Context, pin string, err error) {
+	switch {
+	case errors.Is(err, helpers.ErrInvalidPin), errors.Is(err, helpers.ErrMaxAttemptsReached):
+		status.HandleError(c, http.StatusUnauthorized, InvalidCredentialsMessage, err)
+	case errors.Is(err, helpers.ErrAccountLocked), errors.Is(err, helpers.ErrPinThrottled):
+		if err := helpers.VerifyDummyPassword(c.Request.Context(), pin); err != nil {
+			handleHashingError(c, "Something went wrong while checking user data", err)
+			return
+		}
+		status.HandleError(c, http.StatusUnauthorized, InvalidCredentialsMessage, err)
+	default:
+		handleHashingError(c, "Something went wrong while checking user data", err)
+	}
 }
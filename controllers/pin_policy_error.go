@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emmadal/feeti-auth/helpers"
+	"github.com/gin-gonic/gin"
+)
+
+// handlePinPolicyError maps a PIN policy error to an HTTP response with the reasons in the client language
+func handlePinPolicyError(c *gin.Context, err error) {
+	var policyErr *helpers.PinPolicyError
+	if !errors.As(err, &policyErr) {
+		handleHashingError(c, "Unable to check PIN", err)
+		return
+	}
+
+	language := helpers.PinLanguage(c.GetHeader("Accept-Language"))
+	c.SecureJSON(
+		http.StatusUnprocessableEntity, gin.H{
+			"message": policyErr.Message(language),
+			"success": false,
+			"data":    gin.H{"reasons": policyErr.Localize(language)},
+		},
+	)
+}
@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/emmadal/feeti-auth/helpers"
+	"github.com/emmadal/feeti-auth/models"
+	jwt "github.com/emmadal/feeti-module/auth"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// RefreshToken rotates the refresh token and issues a new access token
+func RefreshToken(c *gin.Context) {
+	// Increment counter for HTTP requests total to prometheus
+	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
+
+	var body models.RefreshTokenRequest
+
+	// Mobile clients send the token in the body, browsers in the cookie
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			status.HandleError(c, http.StatusBadRequest, "Bad request", err)
+			return
+		}
+	}
+	if body.RefreshToken == "" {
+		if cookie, err := c.Cookie(helpers.RefreshCookieName); err == nil {
+			body.RefreshToken = cookie
+		}
+	}
+	if body.RefreshToken == "" {
+		status.HandleError(c, http.StatusUnauthorized, "Missing refresh token", nil)
+		return
+	}
+
+	newToken, err := helpers.GenerateRefreshToken()
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to generate token", err)
+		return
+	}
+
+	// Rotate the refresh token
+	next, err := models.RotateRefreshToken(
+		helpers.HashToken(body.RefreshToken),
+		helpers.HashToken(newToken),
+		time.Now().Add(helpers.RefreshTokenTTL()),
+	)
+	if err != nil {
+		jwt.ClearAuthCookie(c, "")
+		helpers.ClearRefreshCookie(c, "")
+		if errors.Is(err, models.ErrRefreshTokenReused) {
+			helpers.ForgetSessions(next.FamilyID)
+			go recordRefreshTokenReuse(next.UserID, next.FamilyID)
+			status.HandleError(c, http.StatusUnauthorized, "Session expired. Please sign in again", err)
+			return
+		}
+		if errors.Is(err, models.ErrRefreshTokenNotFound) ||
+			errors.Is(err, models.ErrRefreshTokenExpired) ||
+			errors.Is(err, models.ErrRefreshTokenRevoked) {
+			status.HandleError(c, http.StatusUnauthorized, "Session expired. Please sign in again", err)
+			return
+		}
+		status.HandleError(c, http.StatusInternalServerError, "Unable to refresh token", err)
+		return
+	}
+
+	// Generate JWT token for the same session
+	token, err := helpers.GenerateAccessToken(next.UserID, next.FamilyID)
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to generate token", err)
+		return
+	}
+
+	// Set cookies
+	jwt.SetSecureCookie(c, token, os.Getenv("DOMAIN"))
+	helpers.SetRefreshCookie(c, newToken, os.Getenv("DOMAIN"))
+
+	// Return success response
+	status.HandleSuccessData(c, "Token refreshed successfully", gin.H{"refresh_token": newToken})
+}
+
+// issueTokens starts a new session for the user, sets the access token cookie and the session's first
+// refresh token. The refresh token is returned so that mobile clients can store it.
+// duress flags the session as opened with the duress PIN. The flag is only kept server-side.
+func issueTokens(c *gin.Context, userID uuid.UUID, deviceToken string, duress bool) (string, error) {
+	refreshToken, _, err := issueSessionTokens(c, userID, deviceToken, duress)
+	return refreshToken, err
+}
+
+// issueSessionTokens is issueTokens that also returns the new session ID
+func issueSessionTokens(c *gin.Context, userID uuid.UUID, deviceToken string, duress bool) (string, uuid.UUID, error) {
+	session := models.Session{
+		UserID:      userID,
+		DeviceToken: deviceToken,
+		IPAddress:   c.ClientIP(),
+		UserAgent:   c.Request.UserAgent(),
+		ExpiresAt:   time.Now().Add(helpers.RefreshTokenTTL()),
+		Duress:      duress,
+	}
+	if err := session.CreateSession(); err != nil {
+		return "", uuid.Nil, err
+	}
+
+	token, err := helpers.GenerateAccessToken(userID, session.ID)
+	if err != nil {
+		return "", uuid.Nil, err
+	}
+
+	refreshToken, err := helpers.GenerateRefreshToken()
+	if err != nil {
+		return "", uuid.Nil, err
+	}
+	stored := models.RefreshToken{
+		UserID:    userID,
+		FamilyID:  session.ID,
+		TokenHash: helpers.HashToken(refreshToken),
+		ExpiresAt: session.ExpiresAt,
+	}
+	if err := stored.CreateRefreshToken(); err != nil {
+		return "", uuid.Nil, err
+	}
+
+	jwt.SetSecureCookie(c, token, os.Getenv("DOMAIN"))
+	helpers.SetRefreshCookie(c, refreshToken, os.Getenv("DOMAIN"))
+	return refreshToken, session.ID, nil
+}
+
+// recordRefreshTokenReuse records a refresh token reuse in the user's auth logs
+func recordRefreshTokenReuse(userID, familyID uuid.UUID) {
+	user, err := models.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error fetching user for refresh token reuse: %v\n", err)
+		return
+	}
+	authLog := models.AuthLog{
+		UserID:      user.ID,
+		PhoneNumber: user.PhoneNumber,
+		DeviceToken: user.DeviceToken,
+		Activity:    "refresh_token_reuse",
+		Metadata:    `{"source": "token_refresh", "family_id": "` + familyID.String() + `"}`,
+	}
+	if err := authLog.CreateAuthLog(); err != nil {
+		log.Printf("Error creating auth log: %v\n", err)
+	}
+}
@@ -1,26 +1,27 @@
 package controllers
 
 import (
-	"encoding/json"
 	"github.com/emmadal/feeti-auth/helpers"
 	"github.com/emmadal/feeti-auth/models"
-	jwt "github.com/emmadal/feeti-module/auth"
 	status "github.com/emmadal/feeti-module/status"
-	"github.com/emmadal/feeti-module/subject"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"log"
 	"net/http"
-	"os"
+	"time"
 )
 
-// Register handles user registration
+const (
+	MaxPendingRegistrations   = 3
+	PendingRegistrationWindow = time.Hour
+)
+
+// Register starts a user registration and sends a verification code to the phone number.
+// Nothing is persisted in users until the code is confirmed with ConfirmRegister.
 func Register(c *gin.Context) {
 	// Increment counter for HTTP requests total to prometheus
 	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
 
 	var body models.User
-	var response helpers.ResponsePayload
 
 	// Validate the request body
 	if err := c.ShouldBindJSON(&body); err != nil {
@@ -28,87 +29,92 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	// search if the user exists in DB
-	if body.CheckUserByPhone() {
-		status.HandleError(c, http.StatusConflict, "User already exist", nil)
-		return
+	// Drop stale pending registrations before applying the rate limit
+	if err := models.PurgePendingRegistrations(time.Now().Add(-24 * time.Hour)); err != nil {
+		log.Printf("Error purging pending registrations: %v\n", err)
 	}
 
-	// Hash the user's PIN
-	hashedPin, err := helpers.HashPassword(body.Pin)
+	// Rate limit registrations per phone number. Notices to registered numbers count as registrations.
+	since := time.Now().Add(-PendingRegistrationWindow)
+	count, err := models.CountPendingRegistrations(body.PhoneNumber, since)
 	if err != nil {
-		status.HandleError(c, http.StatusInternalServerError, "Unable to process PIN", err)
+		status.HandleError(c, http.StatusInternalServerError, "Unable to process registration", err)
 		return
 	}
-
-	// Create a user account
-	body.Pin = hashedPin
-	user, err := body.CreateUser()
+	notices, err := models.CountOTPs(body.PhoneNumber, models.OTPPurposeAccountExists, since)
 	if err != nil {
-		status.HandleError(c, http.StatusUnprocessableEntity, "Unable to process user", err)
+		status.HandleError(c, http.StatusInternalServerError, "Unable to process registration", err)
+		return
+	}
+	if count+notices >= MaxPendingRegistrations {
+		status.HandleError(c, http.StatusTooManyRequests, "Too many registration attempts. Please try again later", nil)
 		return
 	}
 
-	// create a user wallet
-	pMessage := helpers.RequestPayload{
-		Subject: subject.SubjectWalletCreate,
-		Data:    user.ID.String(),
+	// Reject guessable PINs and PINs without the policy length
+	policy := helpers.GetPinPolicy()
+	if err := policy.Check(body.Pin); err != nil {
+		handlePinPolicyError(c, err)
+		return
 	}
 
-	// Send the initial wallet creation request
-	natsMsg, err := pMessage.PublishEvent()
+	// Hash the user's PIN
+	hashedPin, err := helpers.HashPassword(c.Request.Context(), body.Pin)
 	if err != nil {
-		_ = user.RollbackUser()
-		status.HandleError(c, http.StatusUnprocessableEntity, "Unable to request wallet creation", err)
+		handleHashingError(c, "Unable to process PIN", err)
 		return
 	}
 
-	_ = json.Unmarshal(natsMsg.Data, &response)
-
-	// Convert response.Data from map[string]interface{} to models.Wallet
-	walletData := response.Data.(map[string]any)
-	wallet := models.Wallet{
-		ID:       uuid.MustParse(walletData["id"].(string)),
-		Balance:  walletData["balance"].(float64),
-		Currency: walletData["currency"].(string),
+	// A registered number gets a notice through the OTP channel and the same response as a new one,
+	// so that registering does not tell whether a number has an account. The key UID is a registration code
+	// that is never sent, so that confirming it fails and runs out of attempts like a wrong code.
+	if body.CheckUserByPhone() {
+		if _, err := helpers.SendAccountExistsNotice(body.PhoneNumber); err != nil {
+			status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+			return
+		}
+		decoy, err := helpers.IssueDecoyOTP(body.PhoneNumber, models.OTPPurposeRegister)
+		if err != nil {
+			status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+			return
+		}
+		status.HandleSuccessData(
+			c, "Verification code sent", gin.H{
+				"key_uid":    decoy.KeyUID,
+				"expires_at": decoy.ExpiresAt,
+			},
+		)
+		return
 	}
 
-	// Generate JWT token
-	token, err := jwt.GenerateToken(user.ID, []byte(os.Getenv("JWT_KEY")))
+	// Issue and send the OTP
+	otp, err := helpers.IssueOTP(body.PhoneNumber, models.OTPPurposeRegister)
 	if err != nil {
-		status.HandleError(c, http.StatusInternalServerError, "Unable to generate token", err)
+		status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
 		return
 	}
 
-	// Set cookie
-	jwt.SetSecureCookie(c, token, os.Getenv("DOMAIN"))
-
-	// record auth log
-	go func() {
-		authLog := models.AuthLog{
-			UserID:      user.ID,
-			PhoneNumber: user.PhoneNumber,
-			DeviceToken: user.DeviceToken,
-			Activity:    "register",
-			Metadata:    `{"source": "register"}`,
-		}
-		if err := authLog.CreateAuthLog(); err != nil {
-			log.Printf("Error creating auth log: %v\n", err)
-		}
-	}()
+	// Keep the registration pending until the OTP is confirmed
+	pending := models.PendingRegistration{
+		KeyUID:      otp.KeyUID,
+		FirstName:   body.FirstName,
+		LastName:    body.LastName,
+		PhoneNumber: body.PhoneNumber,
+		DeviceToken: body.DeviceToken,
+		Pin:         hashedPin,
+		PinLength:   policy.Length,
+		ExpiresAt:   otp.ExpiresAt,
+	}
+	if err := pending.CreatePendingRegistration(); err != nil {
+		status.HandleError(c, http.StatusUnprocessableEntity, "Unable to process registration", err)
+		return
+	}
 
 	// Send success response
 	status.HandleSuccessData(
-		c, "User registered successfully", models.AuthResponse{
-			User: models.UserResponse{
-				ID:          user.ID,
-				PhoneNumber: user.PhoneNumber,
-				FirstName:   user.FirstName,
-				LastName:    user.LastName,
-				Photo:       user.Photo,
-				DeviceToken: user.DeviceToken,
-			},
-			Wallet: wallet,
+		c, "Verification code sent", gin.H{
+			"key_uid":    otp.KeyUID,
+			"expires_at": otp.ExpiresAt,
 		},
 	)
 }
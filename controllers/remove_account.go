@@ -1,12 +1,11 @@
 package controllers
 
 import (
-	"encoding/json"
+	"errors"
 	"github.com/emmadal/feeti-auth/helpers"
 	"github.com/emmadal/feeti-auth/models"
 	jwt "github.com/emmadal/feeti-module/auth"
 	status "github.com/emmadal/feeti-module/status"
-	"github.com/emmadal/feeti-module/subject"
 	"github.com/gin-gonic/gin"
 	"log"
 	"net/http"
@@ -18,7 +17,6 @@ func RemoveAccount(c *gin.Context) {
 	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
 
 	body := models.RemoveUserAccount{}
-	var response helpers.ResponsePayload
 
 	// Validate request body
 	if err := c.ShouldBindJSON(&body); err != nil {
@@ -26,51 +24,62 @@ func RemoveAccount(c *gin.Context) {
 		return
 	}
 
-	// search if a user exists in DB
-	user, err := models.GetUserByPhoneNumber(body.PhoneNumber)
-	if err != nil {
-		status.HandleError(c, http.StatusNotFound, "Invalid phone number or user PIN", err)
+	if !helpers.GetPinPolicy().ValidPin(body.Pin) {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", nil)
 		return
 	}
 
-	// verify user identity with context data
-	if user.ID != jwt.GetUserIDFromGin(c) {
-		status.HandleError(c, http.StatusForbidden, "Unauthorized user", err)
+	// An unknown phone number, the number of another user and a wrong PIN get the same answer
+	user, err := models.GetUserByPhoneNumber(body.PhoneNumber)
+	if err != nil && !errors.Is(err, models.ErrUserNotFound) {
+		status.HandleError(c, http.StatusInternalServerError, "Failed to remove account", err)
 		return
 	}
-
-	// verify user password
-	if !helpers.VerifyPassword(body.Pin, user.Pin) {
-		status.HandleError(c, http.StatusUnauthorized, "invalid password or phone number", err)
+	if err != nil || user.ID != jwt.GetUserIDFromGin(c) {
+		if err := helpers.VerifyDummyPassword(c.Request.Context(), body.Pin); err != nil {
+			handleHashingError(c, "Failed to remove account", err)
+			return
+		}
+		status.HandleError(c, http.StatusUnauthorized, InvalidCredentialsMessage, err)
 		return
 	}
 
-	// publish a request to get wallet data
-	request := helpers.RequestPayload{
-		Subject: subject.SubjectWalletLock,
-		Data:    user.ID.String(),
-	}
-	resp, err := request.PublishEvent()
+	// verify user password, or the duress PIN the session was opened with
+	match, _, err := helpers.VerifyPassword(c.Request.Context(), body.Pin, sessionPinHash(c, user))
 	if err != nil {
-		status.HandleError(c, http.StatusInternalServerError, "Unable to process wallet", err)
+		handleHashingError(c, "Failed to remove account", err)
+		return
+	}
+	if !match {
+		status.HandleError(c, http.StatusUnauthorized, InvalidCredentialsMessage, nil)
 		return
 	}
 
-	// Unmarshal the wallet data
-	_ = json.Unmarshal(resp.Data, &response)
-	if !response.Success {
-		status.HandleError(c, http.StatusUnprocessableEntity, response.Error, nil)
+	// Lock the wallet before the account is removed
+	if err := helpers.WalletClient().Lock(c.Request.Context(), user.ID); err != nil {
+		handleWalletError(c, err)
 		return
 	}
 
 	// remove a user account
-	if err := user.DeactivateUserAccount(); err != nil {
+	deactivated, err := helpers.NewEventMessage(helpers.UserDeactivated{UserID: user.ID})
+	if err != nil {
 		status.HandleError(c, http.StatusInternalServerError, "Failed to remove account", err)
 		return
 	}
+	if err := user.DeactivateUserAccount(deactivated); err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Failed to remove account", err)
+		return
+	}
+
+	// Revoke every session of the user
+	if err := helpers.RevokeUserSessions(user.ID); err != nil {
+		log.Printf("Error revoking sessions: %v\n", err)
+	}
 
-	// Send success response and delete cookie
+	// Send success response and delete cookies
 	jwt.ClearAuthCookie(c, "")
+	helpers.ClearRefreshCookie(c, "")
 
 	// record auth log
 	go func() {
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/emmadal/feeti-auth/helpers"
+	"github.com/emmadal/feeti-auth/models"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+)
+
+// ResetPin replaces the user's PIN once the reset code is verified
+func ResetPin(c *gin.Context) {
+	// Increment counter for HTTP requests total to prometheus
+	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
+
+	body := models.ResetPin{}
+
+	// Validate the request body
+	if err := c.ShouldBindJSON(&body); err != nil {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", err)
+		return
+	}
+
+	// Reject guessable PINs before the code is consumed
+	policy := helpers.GetPinPolicy()
+	if err := policy.Check(body.Pin); err != nil {
+		handlePinPolicyError(c, err)
+		return
+	}
+
+	keyUID, err := uuid.Parse(body.KeyUID)
+	if err != nil {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", err)
+		return
+	}
+
+	// Check the code before anything else is hashed, so that neither the time taken nor the answer depends on the
+	// account until the code matches. It is only consumed once the PIN passes, so that a rejected PIN can be replaced.
+	if err := helpers.MatchOTP(keyUID, body.PhoneNumber, models.OTPPurposeResetPin, body.CodeOTP); err != nil {
+		handleOTPError(c, err)
+		return
+	}
+
+	// Fetch user
+	user, err := models.GetUserByPhoneNumber(body.PhoneNumber)
+	if err != nil && !errors.Is(err, models.ErrUserNotFound) {
+		status.HandleError(c, http.StatusInternalServerError, "Failed to reset PIN", err)
+		return
+	}
+
+	// Reject previous PINs
+	if user != nil {
+		if err := policy.CheckReuse(c.Request.Context(), user, body.Pin); err != nil {
+			handlePinPolicyError(c, err)
+			return
+		}
+	}
+
+	// Consume the OTP
+	if err := helpers.CheckOTP(keyUID, body.PhoneNumber, models.OTPPurposeResetPin, body.CodeOTP); err != nil {
+		handleOTPError(c, err)
+		return
+	}
+
+	// A code issued for an unknown number is never sent, answer it like a wrong one
+	if user == nil {
+		status.HandleError(c, http.StatusUnauthorized, "Invalid verification code", nil)
+		return
+	}
+
+	// Hash new PIN
+	hashedPin, err := helpers.HashPassword(c.Request.Context(), body.Pin)
+	if err != nil {
+		handleHashingError(c, "Failed to process new PIN", err)
+		return
+	}
+
+	// Replace the PIN and clear quota and lock, unlocking the wallet of a locked account
+	user.Pin = hashedPin
+	user.PinLength = policy.Length
+	pinChanged, err := helpers.NewEventMessage(helpers.UserPinChanged{UserID: user.ID, Reason: "reset"})
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Failed to reset PIN", err)
+		return
+	}
+	if err := helpers.ResetUserPin(user, pinChanged); err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Failed to reset PIN", err)
+		return
+	}
+
+	// Sign out every device that used the forgotten PIN
+	if err := helpers.RevokeUserSessions(user.ID); err != nil {
+		log.Printf("Error revoking sessions: %v\n", err)
+	}
+
+	// record auth log
+	go func() {
+		authLog := models.AuthLog{
+			UserID:      user.ID,
+			PhoneNumber: user.PhoneNumber,
+			DeviceToken: user.DeviceToken,
+			Activity:    "reset_pin",
+			Metadata:    `{"source": "reset_pin"}`,
+		}
+		if err := authLog.CreateAuthLog(); err != nil {
+			log.Printf("Error creating auth log: %v\n", err)
+		}
+	}()
+
+	// Return success
+	status.HandleSuccess(c, "Your PIN has been reset. Please, do not share your password")
+}
+
+// handleOTPError maps an OTP verification error to an HTTP response
+func handleOTPError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrOTPNotFound), errors.Is(err, models.ErrOTPInvalid):
+		status.HandleError(c, http.StatusUnauthorized, "Invalid verification code", err)
+	case errors.Is(err, models.ErrOTPExpired), errors.Is(err, models.ErrOTPUsed):
+		status.HandleError(c, http.StatusGone, "Verification code expired. Please request a new one", err)
+	case errors.Is(err, models.ErrOTPExhausted):
+		status.HandleError(c, http.StatusTooManyRequests, "Too many attempts. Please request a new code", err)
+	default:
+		status.HandleError(c, http.StatusInternalServerError, "Unable to verify code", err)
+	}
+}
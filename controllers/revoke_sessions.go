@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"github.com/emmadal/feeti-auth/helpers"
+	"github.com/emmadal/feeti-auth/models"
+	jwt "github.com/emmadal/feeti-module/auth"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+)
+
+// RevokeAllSessions signs the user out of every device, including the current one
+func RevokeAllSessions(c *gin.Context) {
+	// Increment counter for HTTP requests total to prometheus
+	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
+
+	userID := jwt.GetUserIDFromGin(c)
+
+	// Revoke every session of the user
+	if err := helpers.RevokeUserSessions(userID); err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to revoke sessions", err)
+		return
+	}
+
+	// Delete cookies
+	jwt.ClearAuthCookie(c, "")
+	helpers.ClearRefreshCookie(c, "")
+
+	// record auth log
+	go func() {
+		user, err := models.GetUserByID(userID)
+		if err != nil {
+			log.Printf("Error fetching user for auth log: %v\n", err)
+			return
+		}
+		authLog := models.AuthLog{
+			UserID:      user.ID,
+			PhoneNumber: user.PhoneNumber,
+			DeviceToken: user.DeviceToken,
+			Activity:    "revoke_sessions",
+			Metadata:    `{"source": "revoke_sessions"}`,
+		}
+		if err := authLog.CreateAuthLog(); err != nil {
+			log.Printf("Error creating auth log: %v\n", err)
+		}
+	}()
+
+	// Return success response
+	status.HandleSuccess(c, "Signed out of all devices")
+}
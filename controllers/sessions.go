@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"github.com/emmadal/feeti-auth/helpers"
+	"github.com/emmadal/feeti-auth/models"
+	jwt "github.com/emmadal/feeti-module/auth"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// ListSessions lists the active sessions of the signed-in user
+func ListSessions(c *gin.Context) {
+	// Increment counter for HTTP requests total to prometheus
+	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
+
+	currentSessionID := helpers.GetSessionIDFromGin(c)
+
+	sessions, err := models.GetActiveSessions(jwt.GetUserIDFromGin(c))
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to fetch sessions", err)
+		return
+	}
+
+	response := make([]models.SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, models.SessionResponse{
+			ID:         session.ID,
+			IPAddress:  session.IPAddress,
+			UserAgent:  session.UserAgent,
+			Current:    session.ID == currentSessionID,
+			LastSeenAt: session.LastSeenAt,
+			CreatedAt:  session.CreatedAt,
+		})
+	}
+
+	// Return success response
+	status.HandleSuccessData(c, "Sessions fetched successfully", response)
+}
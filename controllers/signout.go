@@ -6,6 +6,7 @@ import (
 	jwt "github.com/emmadal/feeti-module/auth"
 	status "github.com/emmadal/feeti-module/status"
 	"github.com/gin-gonic/gin"
+	"net/http"
 )
 
 // SignOut handles user sign out
@@ -14,8 +15,15 @@ func SignOut(c *gin.Context) {
 	// Increment counter for HTTP requests total to prometheus
 	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
 
-	// Delete cookie
+	// Revoke the current session and its refresh tokens
+	if err := helpers.RevokeSession(helpers.GetSessionIDFromGin(c)); err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to sign out", err)
+		return
+	}
+
+	// Delete cookies
 	jwt.ClearAuthCookie(c, "")
+	helpers.ClearRefreshCookie(c, "")
 
 	// Return success response
 	status.HandleSuccess(c, "Successfully signed out")
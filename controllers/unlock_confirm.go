@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emmadal/feeti-auth/helpers"
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/emmadal/feeti-auth/ratelimit"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+)
+
+// UnlockConfirm unlocks the account and its wallet once the unlock code is verified
+func UnlockConfirm(c *gin.Context) {
+	// Increment counter for HTTP requests total to prometheus
+	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
+
+	body := models.UnlockConfirm{}
+
+	// Validate the request body
+	if err := c.ShouldBindJSON(&body); err != nil {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", err)
+		return
+	}
+
+	keyUID, err := uuid.Parse(body.KeyUID)
+	if err != nil {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", err)
+		return
+	}
+
+	// Rate limit unlock attempts per phone number. The attempt is counted before the code is checked.
+	limit := ratelimit.Limit{Burst: MaxUnlockConfirmAttempts, Period: UnlockWindow}
+	if !helpers.TakeAttempt(c.Request.Context(), "unlock-attempt:"+body.PhoneNumber, limit).Allowed {
+		status.HandleError(c, http.StatusTooManyRequests, "Too many unlock attempts. Please try again later", nil)
+		return
+	}
+
+	// Fetch user
+	userStruct := &models.User{PhoneNumber: body.PhoneNumber}
+	user, err := userStruct.GetUserByPhone()
+	if err != nil && !errors.Is(err, models.ErrUserNotFound) {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to unlock account", err)
+		return
+	}
+
+	// Verify and consume the OTP
+	if err := helpers.CheckOTP(keyUID, body.PhoneNumber, models.OTPPurposeUnlock, body.CodeOTP); err != nil {
+		if user != nil {
+			recordUnlockConfirm(user, false)
+		}
+		handleOTPError(c, err)
+		return
+	}
+
+	// A code issued for an unknown number is answered like a wrong one
+	if user == nil {
+		status.HandleError(c, http.StatusUnauthorized, "Invalid verification code", nil)
+		return
+	}
+
+	// Unlock the account and its wallet
+	if err := helpers.UnlockUser(user, "otp"); err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to unlock account", err)
+		return
+	}
+	recordUnlockConfirm(user, true)
+
+	// Return success
+	status.HandleSuccess(c, "Your account has been unlocked")
+}
+
+// recordUnlockConfirm records an unlock attempt in the auth logs
+func recordUnlockConfirm(user *models.User, unlocked bool) {
+	go func() {
+		authLog := models.AuthLog{
+			UserID:      user.ID,
+			PhoneNumber: user.PhoneNumber,
+			DeviceToken: user.DeviceToken,
+			Activity:    "unlock_confirm",
+			Metadata:    fmt.Sprintf(`{"source": "unlock", "unlocked": %t}`, unlocked),
+		}
+		if err := authLog.CreateAuthLog(); err != nil {
+			log.Printf("Error creating auth log: %v\n", err)
+		}
+	}()
+}
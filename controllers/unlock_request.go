@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/emmadal/feeti-auth/helpers"
+	"github.com/emmadal/feeti-auth/models"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	MaxUnlockRequests        = 3
+	MaxUnlockConfirmAttempts = 5
+	UnlockWindow             = time.Hour
+)
+
+// UnlockRequest sends an unlock code to the phone number of a locked account.
+// An unknown number or an account that is not locked gets the same response, with a code that is never sent.
+func UnlockRequest(c *gin.Context) {
+	// Increment counter for HTTP requests total to prometheus
+	helpers.HttpRequestsTotal.WithLabelValues(c.Request.URL.Path, c.Request.Method).Inc()
+
+	body := models.UnlockRequest{}
+
+	// Validate the request body
+	if err := c.ShouldBindJSON(&body); err != nil {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", err)
+		return
+	}
+
+	// Rate limit unlock codes per phone number, known or not
+	count, err := models.CountOTPs(body.PhoneNumber, models.OTPPurposeUnlock, time.Now().Add(-UnlockWindow))
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+		return
+	}
+	if count >= MaxUnlockRequests {
+		status.HandleError(c, http.StatusTooManyRequests, "Too many unlock requests. Please try again later", nil)
+		return
+	}
+
+	// Fetch user
+	userStruct := &models.User{PhoneNumber: body.PhoneNumber}
+	user, err := userStruct.GetUserByPhone()
+	if err != nil && !errors.Is(err, models.ErrUserNotFound) {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+		return
+	}
+	if user == nil || !user.Locked {
+		// Answer like a locked account
+		decoy, err := helpers.IssueDecoyOTP(body.PhoneNumber, models.OTPPurposeUnlock)
+		if err != nil {
+			status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+			return
+		}
+		sendUnlockCode(c, decoy)
+		return
+	}
+
+	// Issue and send the OTP
+	otp, err := helpers.IssueOTP(user.PhoneNumber, models.OTPPurposeUnlock)
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Unable to send verification code", err)
+		return
+	}
+
+	// record auth log
+	go func() {
+		authLog := models.AuthLog{
+			UserID:      user.ID,
+			PhoneNumber: user.PhoneNumber,
+			DeviceToken: user.DeviceToken,
+			Activity:    "unlock_request",
+			Metadata:    `{"source": "unlock"}`,
+		}
+		if err := authLog.CreateAuthLog(); err != nil {
+			log.Printf("Error creating auth log: %v\n", err)
+		}
+	}()
+
+	sendUnlockCode(c, otp)
+}
+
+// sendUnlockCode answers with the key UID of the unlock code
+func sendUnlockCode(c *gin.Context, otp *models.OTP) {
+	status.HandleSuccessData(
+		c, "Verification code sent", gin.H{
+			"key_uid":    otp.KeyUID,
+			"expires_at": otp.ExpiresAt,
+		},
+	)
+}
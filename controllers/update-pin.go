@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"errors"
 	"github.com/emmadal/feeti-auth/helpers"
 	"github.com/emmadal/feeti-auth/models"
 	jwt "github.com/emmadal/feeti-module/auth"
@@ -8,7 +9,6 @@ import (
 	"github.com/gin-gonic/gin"
 	"log"
 	"net/http"
-	"os"
 )
 
 // UpdatePin handles user PIN update
@@ -24,6 +24,13 @@ func UpdatePin(c *gin.Context) {
 		return
 	}
 
+	// The old PIN may still have the legacy length
+	policy := helpers.GetPinPolicy()
+	if !policy.ValidPin(body.OldPin) {
+		status.HandleError(c, http.StatusBadRequest, "Bad request", nil)
+		return
+	}
+
 	// Fetch user
 	user, err := models.GetUserByPhoneNumber(body.PhoneNumber)
 	if err != nil {
@@ -37,36 +44,76 @@ func UpdatePin(c *gin.Context) {
 		return
 	}
 
-	// Verify old PIN
-	if !helpers.VerifyPassword(body.OldPin, user.Pin) {
+	// Verify old PIN. Under duress, the old PIN is the duress PIN the session was opened with.
+	duress := helpers.IsDuressSession(c)
+	match, _, err := helpers.VerifyPassword(c.Request.Context(), body.OldPin, sessionPinHash(c, user))
+	if err != nil {
+		handleHashingError(c, "Failed to update PIN", err)
+		return
+	}
+	if !match {
 		status.HandleError(c, http.StatusUnauthorized, "invalid password or phone number", err)
 		return
 	}
 
+	// Reject guessable PINs and previous PINs
+	if err := policy.Check(body.NewPin); err != nil {
+		handlePinPolicyError(c, err)
+		return
+	}
+	if duress {
+		// The PIN is not changed under duress, answer as if the duress PIN were the only PIN
+		if match, _, err = helpers.VerifyPassword(c.Request.Context(), body.NewPin, sessionPinHash(c, user)); err != nil {
+			handleHashingError(c, "Failed to update PIN", err)
+			return
+		}
+		if match {
+			handlePinPolicyError(c, &helpers.PinPolicyError{Reasons: []string{helpers.PinReasonReused}, Length: policy.Length})
+			return
+		}
+		updateDuressPin(c, user)
+		return
+	}
+	if err := policy.CheckReuse(c.Request.Context(), user, body.NewPin); err != nil {
+		handlePinPolicyError(c, err)
+		return
+	}
+
 	// Hash new PIN
-	hashedPin, err := helpers.HashPassword(body.ConfirmPin)
+	hashedPin, err := helpers.HashPassword(c.Request.Context(), body.ConfirmPin)
 	if err != nil {
-		status.HandleError(c, http.StatusInternalServerError, "Failed to process new PIN", err)
+		handleHashingError(c, "Failed to process new PIN", err)
 		return
 	}
 
 	// Update PIN
 	user.Pin = hashedPin
-	if err := user.UpdateUserPin(); err != nil {
+	user.PinLength = policy.Length
+	pinChanged, err := helpers.NewEventMessage(helpers.UserPinChanged{UserID: user.ID, Reason: "update"})
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Failed to update PIN", err)
+		return
+	}
+	if err := user.UpdateUserPin(pinChanged); err != nil {
+		if errors.Is(err, models.ErrPinNotUpdated) {
+			status.HandleError(c, http.StatusLocked, "Your account is locked. Please try again later", err)
+			return
+		}
 		status.HandleError(c, http.StatusInternalServerError, "Failed to update PIN", err)
 		return
 	}
 
-	//Generate JWT token
-	token, err := jwt.GenerateToken(user.ID, []byte(os.Getenv("JWT_KEY")))
+	// Sign out every device, then replace old tokens with new ones
+	if err := helpers.RevokeUserSessions(user.ID); err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "Failed to revoke sessions", err)
+		return
+	}
+	refreshToken, err := issueTokens(c, user.ID, user.DeviceToken, false)
 	if err != nil {
 		status.HandleError(c, http.StatusInternalServerError, "unexpected token error", err)
 		return
 	}
 
-	// Replace old token with new one
-	jwt.SetSecureCookie(c, token, os.Getenv("DOMAIN"))
-
 	// record auth log
 	go func() {
 		authLog := models.AuthLog{
@@ -82,5 +129,37 @@ func UpdatePin(c *gin.Context) {
 	}()
 
 	// Return success
-	status.HandleSuccess(c, "Your PIN has been updated. Please, do not share your password")
+	status.HandleSuccessData(
+		c, "Your PIN has been updated. Please, do not share your password", gin.H{"refresh_token": refreshToken},
+	)
+}
+
+// updateDuressPin answers a PIN update made under duress like a successful one, without changing the PIN
+// or signing out the other devices. The new session stays flagged.
+func updateDuressPin(c *gin.Context, user *models.User) {
+	refreshToken, err := issueTokens(c, user.ID, user.DeviceToken, true)
+	if err != nil {
+		status.HandleError(c, http.StatusInternalServerError, "unexpected token error", err)
+		return
+	}
+
+	// record auth log
+	go func() {
+		authLog := models.AuthLog{
+			UserID:      user.ID,
+			PhoneNumber: user.PhoneNumber,
+			DeviceToken: user.DeviceToken,
+			Activity:    "update_pin",
+			Metadata:    `{"source": "update_pin", "duress": true}`,
+			Internal:    true,
+		}
+		if err := authLog.CreateAuthLog(); err != nil {
+			log.Printf("Error creating auth log: %v\n", err)
+		}
+	}()
+
+	// Return success
+	status.HandleSuccessData(
+		c, "Your PIN has been updated. Please, do not share your password", gin.H{"refresh_token": refreshToken},
+	)
 }
@@ -0,0 +1,25 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emmadal/feeti-auth/walletclient"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+)
+
+// handleWalletError maps a wallet client error to an HTTP response
+func handleWalletError(c *gin.Context, err error) {
+	var walletErr *walletclient.Error
+	switch {
+	case errors.As(err, &walletErr) && errors.Is(err, walletclient.ErrRejected) && walletErr.Message != "":
+		status.HandleError(c, http.StatusUnprocessableEntity, walletErr.Message, err)
+	case errors.Is(err, walletclient.ErrTimeout):
+		status.HandleError(c, http.StatusGatewayTimeout, "Wallet service did not answer in time", err)
+	case errors.Is(err, walletclient.ErrUnavailable):
+		status.HandleError(c, http.StatusServiceUnavailable, "Wallet service unavailable", err)
+	default:
+		status.HandleError(c, http.StatusUnprocessableEntity, "Unable to process wallet", err)
+	}
+}
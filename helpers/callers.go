@@ -0,0 +1,168 @@
+package helpers
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/nats-io/nats.go"
+)
+
+// ServiceHeader is the header a calling service sets to identify itself when it has no dedicated NATS user.
+// It is only read with NATS_TRUST_SERVICE_HEADER.
+const ServiceHeader = "Feeti-Service"
+
+// defaultUserGetCallers is used when NATS_USER_GET_CALLERS is not set
+const defaultUserGetCallers = "wallet=id,first_name,last_name,phone_number"
+
+// defaultPinVerifyCallers is used when NATS_PIN_VERIFY_CALLERS is not set
+const defaultPinVerifyCallers = "wallet"
+
+// UserDTO is the user returned to other services. Only the fields granted to the caller are set.
+type UserDTO struct {
+	ID          string `json:"id,omitempty"`
+	FirstName   string `json:"first_name,omitempty"`
+	LastName    string `json:"last_name,omitempty"`
+	PhoneNumber string `json:"phone_number,omitempty"`
+	Photo       string `json:"photo,omitempty"`
+	DeviceToken string `json:"device_token,omitempty"`
+	Locked      *bool  `json:"locked,omitempty"`
+}
+
+// requestInfo is the part of the Nats-Request-Info header set by the server on shared service imports
+type requestInfo struct {
+	User string `json:"user"`
+	Name string `json:"name"`
+}
+
+var (
+	userGetCallers     map[string][]string
+	userGetCallersOnce sync.Once
+
+	pinVerifyCallers     map[string]bool
+	pinVerifyCallersOnce sync.Once
+
+	trustServiceHeader     bool
+	trustServiceHeaderOnce sync.Once
+)
+
+// UserGetCallers returns the services allowed to call user.get with their fields, from NATS_USER_GET_CALLERS.
+// The format is "service=field,field;service=field".
+func UserGetCallers() map[string][]string {
+	userGetCallersOnce.Do(func() {
+		config := os.Getenv("NATS_USER_GET_CALLERS")
+		if config == "" {
+			config = defaultUserGetCallers
+		}
+		userGetCallers = parseCallers(config)
+	})
+	return userGetCallers
+}
+
+// PinVerifyCallers returns the services allowed to call auth.pin.verify, from the comma separated NATS_PIN_VERIFY_CALLERS
+func PinVerifyCallers() map[string]bool {
+	pinVerifyCallersOnce.Do(func() {
+		config := os.Getenv("NATS_PIN_VERIFY_CALLERS")
+		if config == "" {
+			config = defaultPinVerifyCallers
+		}
+		pinVerifyCallers = make(map[string]bool)
+		for _, name := range strings.Split(config, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				pinVerifyCallers[name] = true
+			}
+		}
+	})
+	return pinVerifyCallers
+}
+
+// TrustServiceHeader reports whether callers may name themselves with the Feeti-Service header, from
+// NATS_TRUST_SERVICE_HEADER. Any NATS client can set the header, so it is off by default and only meant
+// for development servers without accounts.
+func TrustServiceHeader() bool {
+	trustServiceHeaderOnce.Do(func() {
+		trustServiceHeader, _ = strconv.ParseBool(os.Getenv("NATS_TRUST_SERVICE_HEADER"))
+		if trustServiceHeader {
+			log.Printf("NATS callers are identified by the %s header, which any client can set\n", ServiceHeader)
+		}
+	})
+	return trustServiceHeader
+}
+
+// parseCallers parses a caller allowlist
+func parseCallers(config string) map[string][]string {
+	callers := make(map[string][]string)
+	for _, entry := range strings.Split(config, ";") {
+		name, fields, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || name == "" {
+			continue
+		}
+		for _, field := range strings.Split(fields, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				callers[name] = append(callers[name], field)
+			}
+		}
+	}
+	return callers
+}
+
+// CallerIdentity identifies the service that sent a request: the NATS user reported by the server
+// in Nats-Request-Info, or else the Feeti-Service header when TrustServiceHeader allows it.
+// It is empty for an unidentified caller.
+func CallerIdentity(header nats.Header) string {
+	return callerIdentity(header, TrustServiceHeader())
+}
+
+// callerIdentity identifies the caller, falling back to the Feeti-Service header when trustHeader is set
+func callerIdentity(header nats.Header, trustHeader bool) string {
+	if header == nil {
+		return ""
+	}
+	if raw := header.Get("Nats-Request-Info"); raw != "" {
+		var info requestInfo
+		if err := json.Unmarshal([]byte(raw), &info); err == nil {
+			if info.User != "" {
+				return info.User
+			}
+			if info.Name != "" {
+				return info.Name
+			}
+		} else {
+			log.Printf("Invalid Nats-Request-Info header: %v\n", err)
+		}
+	}
+	if !trustHeader {
+		return ""
+	}
+	return header.Get(ServiceHeader)
+}
+
+// ProjectUser copies the given fields of the user into a DTO. Unknown fields are ignored,
+// so credentials and counters can never be exposed.
+func ProjectUser(user *models.User, fields []string) UserDTO {
+	var dto UserDTO
+	for _, field := range fields {
+		switch field {
+		case "id":
+			dto.ID = user.ID.String()
+		case "first_name":
+			dto.FirstName = user.FirstName
+		case "last_name":
+			dto.LastName = user.LastName
+		case "phone_number":
+			dto.PhoneNumber = user.PhoneNumber
+		case "photo":
+			dto.Photo = user.Photo
+		case "device_token":
+			dto.DeviceToken = user.DeviceToken
+		case "locked":
+			locked := user.Locked
+			dto.Locked = &locked
+		}
+	}
+	return dto
+}
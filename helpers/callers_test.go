@@ -0,0 +1,35 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestCallerIdentity(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      nats.Header
+		trustHeader bool
+		want        string
+	}{
+		{"no header", nil, true, ""},
+		{"request info user", nats.Header{"Nats-Request-Info": {`{"acc":"WALLET","user":"wallet"}`}}, false, "wallet"},
+		{"request info name", nats.Header{"Nats-Request-Info": {`{"acc":"WALLET","name":"wallet"}`}}, false, "wallet"},
+		{
+			"request info wins over the header",
+			nats.Header{"Nats-Request-Info": {`{"user":"wallet"}`}, ServiceHeader: {"payment"}},
+			true, "wallet",
+		},
+		{"untrusted header", nats.Header{ServiceHeader: {"wallet"}}, false, ""},
+		{"trusted header", nats.Header{ServiceHeader: {"wallet"}}, true, "wallet"},
+		{"invalid request info", nats.Header{"Nats-Request-Info": {"{"}, ServiceHeader: {"wallet"}}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := callerIdentity(tt.header, tt.trustHeader); got != tt.want {
+				t.Errorf("got caller %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
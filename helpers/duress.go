@@ -0,0 +1,41 @@
+package helpers
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/google/uuid"
+)
+
+// RecordDuress publishes the duress event and records the use of the duress PIN in an internal auth log.
+// Nothing is sent to the user, so that whoever forces them to sign in is not tipped off.
+// sessionID is the session opened with the duress PIN, uuid.Nil for a PIN verification.
+func RecordDuress(user *models.User, sessionID uuid.UUID, ipAddress, source string) {
+	EmitUserEvent(UserDuress{
+		UserID:      user.ID,
+		SessionID:   sessionID,
+		DeviceToken: user.DeviceToken,
+		IPAddress:   ipAddress,
+		Source:      source,
+	})
+
+	go func() {
+		metadata, _ := json.Marshal(map[string]any{
+			"source":     source,
+			"session_id": sessionID,
+			"ip_address": ipAddress,
+		})
+		authLog := models.AuthLog{
+			UserID:      user.ID,
+			PhoneNumber: user.PhoneNumber,
+			DeviceToken: user.DeviceToken,
+			Activity:    "duress",
+			Metadata:    string(metadata),
+			Internal:    true,
+		}
+		if err := authLog.CreateAuthLog(); err != nil {
+			log.Printf("Error creating auth log: %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,198 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	EventsStreamName    = "AUTH_EVENTS"
+	EventsSubjects      = "auth.user.>"
+	EventSchemaVersion  = 1
+	EventVersionHeader  = "Feeti-Event-Version"
+	defaultEventsMaxAge = 7 * 24 * time.Hour
+)
+
+// Account lifecycle event subjects
+const (
+	EventUserRegistered  = "auth.user.registered"
+	EventUserLocked      = "auth.user.locked"
+	EventUserPinChanged  = "auth.user.pin_changed"
+	EventUserDeactivated = "auth.user.deactivated"
+	EventUserLoggedIn    = "auth.user.logged_in"
+	EventUserUnlocked    = "auth.user.unlocked"
+	EventUserDuress      = "auth.user.duress"
+)
+
+var js jetstream.JetStream
+
+// UserEvent is the payload of an account lifecycle event
+type UserEvent interface {
+	EventType() string
+}
+
+// Event is the envelope published on JetStream. Consumers must check Version before decoding Data.
+type Event struct {
+	ID         uuid.UUID `json:"id"`
+	Type       string    `json:"type"`
+	Version    int       `json:"version"`
+	Source     string    `json:"source"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       UserEvent `json:"data"`
+}
+
+// UserRegistered is published once the phone number is verified and the account created
+type UserRegistered struct {
+	UserID      uuid.UUID `json:"user_id"`
+	PhoneNumber string    `json:"phone_number"`
+	FirstName   string    `json:"first_name"`
+	LastName    string    `json:"last_name"`
+}
+
+// UserLocked is published when failed attempts lock an account. LockedUntil is not set for a permanent lock.
+type UserLocked struct {
+	UserID      uuid.UUID  `json:"user_id"`
+	Attempts    uint       `json:"attempts"`
+	Reason      string     `json:"reason"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	Permanent   bool       `json:"permanent"`
+}
+
+// UserUnlocked is published when a lock is lifted
+type UserUnlocked struct {
+	UserID uuid.UUID `json:"user_id"`
+	Reason string    `json:"reason"`
+}
+
+// UserPinChanged is published when the PIN is updated or reset
+type UserPinChanged struct {
+	UserID uuid.UUID `json:"user_id"`
+	Reason string    `json:"reason"` // "update" or "reset"
+}
+
+// UserDeactivated is published when the user removes its account
+type UserDeactivated struct {
+	UserID uuid.UUID `json:"user_id"`
+}
+
+// UserLoggedIn is published on each successful login
+type UserLoggedIn struct {
+	UserID      uuid.UUID `json:"user_id"`
+	DeviceToken string    `json:"device_token"`
+	IPAddress   string    `json:"ip_address"`
+}
+
+// UserDuress is published when the duress PIN is used, so that the wallet restricts the balance shown
+// and the fraud team is alerted. It is never shown to the user. SessionID is not set for a PIN verification.
+type UserDuress struct {
+	UserID      uuid.UUID `json:"user_id"`
+	SessionID   uuid.UUID `json:"session_id,omitzero"`
+	DeviceToken string    `json:"device_token,omitempty"`
+	IPAddress   string    `json:"ip_address,omitempty"`
+	Source      string    `json:"source"` // "login" or the service that asked for the PIN
+}
+
+func (UserRegistered) EventType() string  { return EventUserRegistered }
+func (UserLocked) EventType() string      { return EventUserLocked }
+func (UserPinChanged) EventType() string  { return EventUserPinChanged }
+func (UserDeactivated) EventType() string { return EventUserDeactivated }
+func (UserLoggedIn) EventType() string    { return EventUserLoggedIn }
+func (UserUnlocked) EventType() string    { return EventUserUnlocked }
+func (UserDuress) EventType() string      { return EventUserDuress }
+
+// eventsMaxAge returns how long events are kept in the stream, from AUTH_EVENTS_MAX_AGE
+func eventsMaxAge() time.Duration {
+	if maxAge, err := time.ParseDuration(os.Getenv("AUTH_EVENTS_MAX_AGE")); err == nil && maxAge > 0 {
+		return maxAge
+	}
+	return defaultEventsMaxAge
+}
+
+// setupEventStream creates or updates the stream that stores account lifecycle events
+func setupEventStream(config NatsConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("unable to create JetStream context: %w", err)
+	}
+	_, err = stream.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:        EventsStreamName,
+		Description: "Feeti account lifecycle events",
+		Subjects:    []string{EventsSubjects},
+		Storage:     jetstream.FileStorage,
+		Replicas:    config.Replicas,
+		MaxAge:      eventsMaxAge(),
+		Duplicates:  2 * time.Minute,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create stream %s: %w", EventsStreamName, err)
+	}
+	js = stream
+	return nil
+}
+
+// NewEvent wraps a payload in a versioned envelope
+func NewEvent(data UserEvent) Event {
+	return Event{
+		ID:         uuid.New(),
+		Type:       data.EventType(),
+		Version:    EventSchemaVersion,
+		Source:     ServiceName,
+		OccurredAt: time.Now().UTC(),
+		Data:       data,
+	}
+}
+
+// PublishUserEvent publishes an event to JetStream and waits for the stream acknowledgement
+func PublishUserEvent(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return publishEventPayload(event.Type, event.ID.String(), payload)
+}
+
+// publishEventPayload publishes an encoded event. The event ID is the message ID,
+// so a retried publish is not stored twice.
+func publishEventPayload(subject, id string, payload []byte) error {
+	if js == nil {
+		return fmt.Errorf("event stream is not ready")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	msg := nats.NewMsg(subject)
+	msg.Data = payload
+	msg.Header.Set(EventVersionHeader, strconv.Itoa(EventSchemaVersion))
+	if _, err := js.PublishMsg(ctx, msg, jetstream.WithMsgID(id)); err != nil {
+		return fmt.Errorf("unable to publish event %s: %w", subject, err)
+	}
+	return nil
+}
+
+// EmitUserEvent writes an event that is not tied to an account change to the outbox.
+// Failures are logged and do not affect the request.
+func EmitUserEvent(data UserEvent) {
+	go func() {
+		msg, err := NewEventMessage(data)
+		if err == nil {
+			err = models.EnqueueOutbox(msg)
+		}
+		if err != nil {
+			log.Printf("Error queueing event %s: %v\n", data.EventType(), err)
+		}
+	}()
+}
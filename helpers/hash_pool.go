@@ -0,0 +1,101 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHashQueueSize    = 64
+	defaultHashQueueTimeout = 2 * time.Second
+)
+
+// ErrHashingBusy is returned when a hash cannot start because the queue is full or its deadline passed
+var ErrHashingBusy = errors.New("pin hashing queue full")
+
+// hashPool runs PIN hashes with bounded concurrency so that a burst of logins cannot take every core.
+// Hashes wait in a bounded queue for a worker, up to the queue timeout or the request deadline.
+type hashPool struct {
+	workers chan struct{}
+	queued  atomic.Int64
+	size    int64
+	timeout time.Duration
+}
+
+var (
+	hashes     *hashPool
+	hashesOnce sync.Once
+)
+
+// hashingPool returns the pool configured from HASH_WORKERS (default: the number of CPUs),
+// HASH_QUEUE_SIZE and HASH_QUEUE_TIMEOUT
+func hashingPool() *hashPool {
+	hashesOnce.Do(func() {
+		workers := runtime.GOMAXPROCS(0)
+		if n, err := strconv.Atoi(os.Getenv("HASH_WORKERS")); err == nil && n > 0 {
+			workers = n
+		}
+		hashes = &hashPool{
+			workers: make(chan struct{}, workers),
+			size:    defaultHashQueueSize,
+			timeout: defaultHashQueueTimeout,
+		}
+		if n, err := strconv.ParseInt(os.Getenv("HASH_QUEUE_SIZE"), 10, 64); err == nil && n >= 0 {
+			hashes.size = n
+		}
+		if timeout, err := time.ParseDuration(os.Getenv("HASH_QUEUE_TIMEOUT")); err == nil && timeout > 0 {
+			hashes.timeout = timeout
+		}
+	})
+	return hashes
+}
+
+// run waits for a worker and runs fn, recording its duration under the operation label
+func (p *hashPool) run(ctx context.Context, operation string, fn func()) error {
+	// Try a free worker first so that an idle pool never queues
+	select {
+	case p.workers <- struct{}{}:
+	default:
+		if err := p.wait(ctx); err != nil {
+			return err
+		}
+	}
+	defer func() { <-p.workers }()
+
+	start := time.Now()
+	fn()
+	HashDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	return nil
+}
+
+// wait queues for a worker, failing right away when the queue is full
+func (p *hashPool) wait(ctx context.Context) error {
+	if p.queued.Add(1) > p.size {
+		p.queued.Add(-1)
+		HashRejectedTotal.WithLabelValues("queue_full").Inc()
+		return ErrHashingBusy
+	}
+	HashQueueDepth.Inc()
+	defer func() {
+		p.queued.Add(-1)
+		HashQueueDepth.Dec()
+	}()
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case p.workers <- struct{}{}:
+		return nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	HashRejectedTotal.WithLabelValues("timeout").Inc()
+	return ErrHashingBusy
+}
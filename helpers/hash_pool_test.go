@@ -0,0 +1,103 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestHashPool returns a pool of one worker, already busy, with the given queue size and timeout
+func newTestHashPool(size int64, timeout time.Duration) *hashPool {
+	pool := &hashPool{workers: make(chan struct{}, 1), size: size, timeout: timeout}
+	pool.workers <- struct{}{}
+	return pool
+}
+
+func TestHashPoolRunsOnIdleWorker(t *testing.T) {
+	pool := &hashPool{workers: make(chan struct{}, 1), size: 0, timeout: time.Second}
+	ran := false
+	if err := pool.run(context.Background(), "hash", func() { ran = true }); err != nil || !ran {
+		t.Fatalf("expected an idle pool to run the hash, got %v", err)
+	}
+	if len(pool.workers) != 0 {
+		t.Error("expected the worker to be released")
+	}
+}
+
+func TestHashPoolRejectsWhenQueueFull(t *testing.T) {
+	pool := newTestHashPool(0, time.Minute)
+
+	start := time.Now()
+	err := pool.run(context.Background(), "hash", func() { t.Error("expected the hash not to run") })
+	if !errors.Is(err, ErrHashingBusy) {
+		t.Fatalf("expected ErrHashingBusy, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("expected a full queue to reject right away")
+	}
+}
+
+func TestHashPoolQueueBound(t *testing.T) {
+	pool := newTestHashPool(1, time.Minute)
+
+	// Fill the queue with one waiting hash
+	done := make(chan error, 1)
+	go func() {
+		done <- pool.run(context.Background(), "hash", func() {})
+	}()
+	deadline := time.Now().Add(time.Second)
+	for pool.queued.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the hash to be queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := pool.run(context.Background(), "hash", func() {}); !errors.Is(err, ErrHashingBusy) {
+		t.Errorf("expected ErrHashingBusy beyond the queue size, got %v", err)
+	}
+
+	// Freeing the worker lets the queued hash run
+	<-pool.workers
+	if err := <-done; err != nil {
+		t.Errorf("expected the queued hash to run, got %v", err)
+	}
+	if pool.queued.Load() != 0 {
+		t.Errorf("expected an empty queue, got %d", pool.queued.Load())
+	}
+}
+
+func TestHashPoolTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		ctx     func() (context.Context, context.CancelFunc)
+	}{
+		{"queue timeout", 20 * time.Millisecond, func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}},
+		{"request deadline", time.Minute, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 20*time.Millisecond)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestHashPool(1, tt.timeout)
+			ctx, cancel := tt.ctx()
+			defer cancel()
+
+			start := time.Now()
+			err := pool.run(ctx, "hash", func() { t.Error("expected the hash not to run") })
+			if !errors.Is(err, ErrHashingBusy) {
+				t.Fatalf("expected ErrHashingBusy, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > 10*time.Second {
+				t.Errorf("expected to wait about 20ms, waited %s", elapsed)
+			}
+			if pool.queued.Load() != 0 {
+				t.Errorf("expected the request to leave the queue, got %d queued", pool.queued.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	AccessTokenTTL = 30 * time.Minute
+	StepUpTokenTTL = 2 * time.Minute
+	TokenIssuer    = "feeti-auth"
+	ScopeUser      = "user"
+	ScopePinVerify = "pin:verified"
+)
+
+// Claims are the access token claims. UserID keeps the claim name used by feeti-module.
+// Whether a session was opened with the duress PIN is never put in a token, since its holder can read it.
+type Claims struct {
+	UserID    uuid.UUID `json:"userID"`
+	SessionID uuid.UUID `json:"sid"`
+	Scope     string    `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+var accessTokenParser = jwt.NewParser(
+	jwt.WithValidMethods([]string{
+		jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodRS256.Alg(), jwt.SigningMethodHS256.Alg(),
+	}),
+)
+
+// GenerateAccessToken generates an access token bound to a session
+func GenerateAccessToken(userID, sessionID uuid.UUID) (string, error) {
+	if userID == uuid.Nil || sessionID == uuid.Nil {
+		return "", fmt.Errorf("invalid token claims")
+	}
+	now := time.Now()
+	claims := Claims{
+		UserID:    userID,
+		SessionID: sessionID,
+		Scope:     ScopeUser,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    TokenIssuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL)),
+		},
+	}
+
+	return signClaims(claims)
+}
+
+// GenerateStepUpToken generates a short-lived token proving that the user has just confirmed its PIN.
+// It has no session, so it is never accepted as an access token, and is scoped to the calling service.
+// tokenID is its jti, under which the token is recorded for introspection.
+func GenerateStepUpToken(tokenID, userID uuid.UUID, audience string) (string, time.Time, error) {
+	if tokenID == uuid.Nil || userID == uuid.Nil || audience == "" {
+		return "", time.Time{}, fmt.Errorf("invalid token claims")
+	}
+	now := time.Now()
+	expiresAt := now.Add(StepUpTokenTTL)
+	claims := Claims{
+		UserID: userID,
+		Scope:  ScopePinVerify,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID.String(),
+			Issuer:    TokenIssuer,
+			Subject:   userID.String(),
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token, err := signClaims(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// signClaims signs claims with the active asymmetric key, or with the JWT_KEY secret when no key is loaded
+func signClaims(claims Claims) (string, error) {
+	if key := activeSigningKey(); key != nil {
+		token := jwt.NewWithClaims(key.Method, claims)
+		token.Header["kid"] = key.ID
+		return token.SignedString(key.Private)
+	}
+
+	secretKey := []byte(os.Getenv("JWT_KEY"))
+	if len(secretKey) == 0 {
+		return "", fmt.Errorf("no signing key configured")
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secretKey)
+}
+
+// VerifyAccessToken verifies an access token and returns its claims
+func VerifyAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := accessTokenParser.ParseWithClaims(tokenString, claims, tokenKey)
+	if err != nil || !token.Valid || claims.SessionID == uuid.Nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
+
+// VerifyStepUpToken verifies the signature and expiry of a step-up token and returns its claims
+func VerifyStepUpToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := accessTokenParser.ParseWithClaims(tokenString, claims, tokenKey)
+	if err != nil || !token.Valid || claims.Scope != ScopePinVerify || claims.SessionID != uuid.Nil || claims.ID == "" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
+
+// tokenKey resolves the verification key from the token's kid header.
+// Tokens without kid are HMAC tokens signed with JWT_KEY, only accepted while tokens are signed with it.
+func tokenKey(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("missing key id")
+		}
+		if !acceptHMACTokens() {
+			return nil, fmt.Errorf("HMAC tokens are no longer accepted")
+		}
+		secretKey := []byte(os.Getenv("JWT_KEY"))
+		if len(secretKey) == 0 {
+			return nil, fmt.Errorf("no verification key configured")
+		}
+		return secretKey, nil
+	}
+
+	key := verificationKey(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	return key.Public, nil
+}
+
+// acceptHMACTokens reports whether tokens signed with JWT_KEY are accepted: when no asymmetric key is active,
+// or during a migration until the RFC 3339 time in JWT_HMAC_ACCEPT_UNTIL
+func acceptHMACTokens() bool {
+	if activeSigningKey() == nil {
+		return true
+	}
+	until, err := time.Parse(time.RFC3339, os.Getenv("JWT_HMAC_ACCEPT_UNTIL"))
+	return err == nil && time.Now().Before(until)
+}
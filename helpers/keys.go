@@ -0,0 +1,303 @@
+package helpers
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultKeyRotationInterval = 30 * 24 * time.Hour
+	keyReloadInterval          = time.Minute
+	keyPrepublish              = 10 * time.Minute
+)
+
+// SigningKey is an asymmetric key used to sign access tokens.
+// A key becomes active at ActivatedAt, which is the modification time of its PEM file.
+type SigningKey struct {
+	ID          string
+	Method      jwt.SigningMethod
+	Private     crypto.Signer
+	Public      crypto.PublicKey
+	ActivatedAt time.Time
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKSet is the document served on /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+var keyStore = struct {
+	sync.RWMutex
+	keys []*SigningKey // sorted by activation time, oldest first
+}{}
+
+// LoadSigningKeys loads the signing keys from JWT_KEYS_DIR, or the single key in JWT_PRIVATE_KEY_FILE.
+// Without any of them, tokens are signed with the JWT_KEY HMAC secret.
+func LoadSigningKeys() error {
+	var keys []*SigningKey
+
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			key, err := loadSigningKey(path, strings.TrimSuffix(filepath.Base(path), ".pem"))
+			if err != nil {
+				return fmt.Errorf("unable to load signing key %s: %w", path, err)
+			}
+			keys = append(keys, key)
+		}
+	} else if path := os.Getenv("JWT_PRIVATE_KEY_FILE"); path != "" {
+		kid := os.Getenv("JWT_KEY_ID")
+		if kid == "" {
+			kid = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		key, err := loadSigningKey(path, kid)
+		if err != nil {
+			return fmt.Errorf("unable to load signing key %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ActivatedAt.Before(keys[j].ActivatedAt)
+	})
+
+	keyStore.Lock()
+	keyStore.keys = keys
+	keyStore.Unlock()
+	return nil
+}
+
+// loadSigningKey parses a PKCS#8 (Ed25519 or RSA) or PKCS#1 (RSA) private key file
+func loadSigningKey(path, kid string) (*SigningKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var parsed any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{ID: kid, ActivatedAt: info.ModTime()}
+	switch private := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.Private = private
+		key.Public = private.Public()
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+		key.Private = private
+		key.Public = private.Public()
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	return key, nil
+}
+
+// keyOverlap returns how long a replaced key stays valid, from JWT_KEY_OVERLAP.
+// It must be at least the access token lifetime so that tokens signed just before a rotation still verify.
+func keyOverlap() time.Duration {
+	if overlap, err := time.ParseDuration(os.Getenv("JWT_KEY_OVERLAP")); err == nil && overlap >= AccessTokenTTL {
+		return overlap
+	}
+	return AccessTokenTTL + 5*time.Minute
+}
+
+// activeSigningKey returns the most recently activated key
+func activeSigningKey() *SigningKey {
+	now := time.Now()
+
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+	for i := len(keyStore.keys) - 1; i >= 0; i-- {
+		if !keyStore.keys[i].ActivatedAt.After(now) {
+			return keyStore.keys[i]
+		}
+	}
+	return nil
+}
+
+// publishedKeys returns the keys that verify tokens: the active key, keys scheduled to become active
+// and keys replaced less than the overlap window ago
+func publishedKeys() []*SigningKey {
+	now := time.Now()
+	overlap := keyOverlap()
+
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+
+	var published []*SigningKey
+	for i, key := range keyStore.keys {
+		if i+1 < len(keyStore.keys) {
+			replacedAt := keyStore.keys[i+1].ActivatedAt
+			if !replacedAt.After(now) && now.Sub(replacedAt) > overlap {
+				continue
+			}
+		}
+		published = append(published, key)
+	}
+	return published
+}
+
+// verificationKey finds a published key by ID
+func verificationKey(kid string) *SigningKey {
+	for _, key := range publishedKeys() {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// JWKS returns the public keys that verify access tokens
+func JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range publishedKeys() {
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch public := key.Public.(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// keyRotationInterval returns the age after which a new key is generated, from JWT_KEY_ROTATION_INTERVAL
+func keyRotationInterval() time.Duration {
+	if interval, err := time.ParseDuration(os.Getenv("JWT_KEY_ROTATION_INTERVAL")); err == nil && interval > 0 {
+		return interval
+	}
+	return defaultKeyRotationInterval
+}
+
+// rotateSigningKey writes a new Ed25519 key to JWT_KEYS_DIR when the active key is older than the rotation interval
+func rotateSigningKey() error {
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		return nil
+	}
+	if active := activeSigningKey(); active != nil && time.Since(active.ActivatedAt) < keyRotationInterval() {
+		return nil
+	}
+	if hasPendingSigningKey() {
+		return nil
+	}
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d.pem", time.Now().Unix()))
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+
+	// Publish the key before it signs anything so that verifiers and other replicas can fetch it first.
+	// The very first key is used right away.
+	activatedAt := time.Now()
+	if activeSigningKey() != nil {
+		activatedAt = activatedAt.Add(keyPrepublish)
+	}
+	if err := os.Chtimes(path, activatedAt, activatedAt); err != nil {
+		return err
+	}
+	log.Printf("Generated signing key %s, active from %s\n", path, activatedAt.Format(time.RFC3339))
+	return nil
+}
+
+// hasPendingSigningKey reports whether a key is scheduled to become active
+func hasPendingSigningKey() bool {
+	now := time.Now()
+
+	keyStore.RLock()
+	defer keyStore.RUnlock()
+	for _, key := range keyStore.keys {
+		if key.ActivatedAt.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// StartKeyRotation reloads the signing keys every minute so that keys added to the directory are picked up.
+// When JWT_KEY_AUTO_GENERATE is true, a new key is generated once the active one reaches the rotation interval.
+func StartKeyRotation() {
+	autoGenerate := os.Getenv("JWT_KEY_AUTO_GENERATE") == "true"
+
+	rotate := func() {
+		if autoGenerate {
+			if err := rotateSigningKey(); err != nil {
+				log.Printf("Error rotating signing key: %v\n", err)
+			}
+		}
+		if err := LoadSigningKeys(); err != nil {
+			log.Printf("Error reloading signing keys: %v\n", err)
+		}
+	}
+
+	rotate()
+	go func() {
+		for range time.Tick(keyReloadInterval) {
+			rotate()
+		}
+	}()
+}
@@ -0,0 +1,173 @@
+package helpers
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/emmadal/feeti-module/subject"
+)
+
+const (
+	defaultLockoutMaxAttempts       = 3
+	defaultLockoutDelays            = "0s,2s,5s"
+	defaultLockoutDuration          = 15 * time.Minute
+	defaultLockoutMaxTemporaryLocks = 3
+	lockoutSweepInterval            = time.Minute
+	lockoutSweepBatch               = 100
+)
+
+// LockoutPolicy decides how failed PIN attempts slow down and lock an account
+type LockoutPolicy struct {
+	// MaxAttempts is the number of consecutive failures that locks the account
+	MaxAttempts int
+	// Delays is the wait imposed after the n-th consecutive failure. The last delay repeats.
+	Delays []time.Duration
+	// LockDuration is the length of the first temporary lock. Each further lock doubles it.
+	LockDuration time.Duration
+	// MaxTemporaryLocks is the number of temporary locks after which the next lock is permanent
+	MaxTemporaryLocks int
+}
+
+var (
+	lockoutPolicy     LockoutPolicy
+	lockoutPolicyOnce sync.Once
+)
+
+// Lockout returns the lockout policy, from LOCKOUT_MAX_ATTEMPTS, LOCKOUT_DELAYS, LOCKOUT_DURATION
+// and LOCKOUT_MAX_TEMPORARY_LOCKS
+func Lockout() LockoutPolicy {
+	lockoutPolicyOnce.Do(func() {
+		lockoutPolicy = LockoutPolicy{
+			MaxAttempts:       defaultLockoutMaxAttempts,
+			Delays:            parseDelays(defaultLockoutDelays),
+			LockDuration:      defaultLockoutDuration,
+			MaxTemporaryLocks: defaultLockoutMaxTemporaryLocks,
+		}
+		if attempts, err := strconv.Atoi(os.Getenv("LOCKOUT_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+			lockoutPolicy.MaxAttempts = attempts
+		}
+		if delays := parseDelays(os.Getenv("LOCKOUT_DELAYS")); len(delays) > 0 {
+			lockoutPolicy.Delays = delays
+		}
+		if duration, err := time.ParseDuration(os.Getenv("LOCKOUT_DURATION")); err == nil && duration > 0 {
+			lockoutPolicy.LockDuration = duration
+		}
+		if locks, err := strconv.Atoi(os.Getenv("LOCKOUT_MAX_TEMPORARY_LOCKS")); err == nil && locks >= 0 {
+			lockoutPolicy.MaxTemporaryLocks = locks
+		}
+	})
+	return lockoutPolicy
+}
+
+// parseDelays parses a comma separated list of durations, ignoring invalid entries
+func parseDelays(config string) []time.Duration {
+	var delays []time.Duration
+	for _, entry := range strings.Split(config, ",") {
+		if delay, err := time.ParseDuration(strings.TrimSpace(entry)); err == nil && delay >= 0 {
+			delays = append(delays, delay)
+		}
+	}
+	return delays
+}
+
+// Delay returns the wait imposed after the given number of consecutive failures
+func (p LockoutPolicy) Delay(failures uint) time.Duration {
+	if failures == 0 || len(p.Delays) == 0 {
+		return 0
+	}
+	return p.Delays[min(int(failures), len(p.Delays))-1]
+}
+
+// LockUntil returns the end of the lock to apply after the given number of previous locks,
+// or nil for a permanent lock
+func (p LockoutPolicy) LockUntil(previousLocks int) *time.Time {
+	if previousLocks >= p.MaxTemporaryLocks {
+		return nil
+	}
+	duration := p.LockDuration
+	for i := 0; i < previousLocks && duration < 24*time.Hour; i++ {
+		duration *= 2
+	}
+	until := time.Now().Add(duration)
+	return &until
+}
+
+// UnlockExpiredUser lifts an expired temporary lock, unlocks the wallet and publishes the unlocked event
+func UnlockExpiredUser(user *models.User) error {
+	walletUnlock, unlocked, err := unlockMessages(user, "lock_expired")
+	if err != nil {
+		return err
+	}
+	done, err := user.UnlockExpiredUser(walletUnlock, unlocked)
+	if err != nil || !done {
+		return err
+	}
+	deliverWalletUnlock(user, walletUnlock)
+	return nil
+}
+
+// UnlockUser lifts any lock of the user, unlocks the wallet and publishes the unlocked event
+func UnlockUser(user *models.User, reason string) error {
+	walletUnlock, unlocked, err := unlockMessages(user, reason)
+	if err != nil {
+		return err
+	}
+	if err := user.UnlockUser(walletUnlock, unlocked); err != nil {
+		return err
+	}
+	deliverWalletUnlock(user, walletUnlock)
+	return nil
+}
+
+// ResetUserPin replaces the PIN of the user and lifts any lock. When the account was locked, the wallet is unlocked
+// and the unlocked event published, as with UnlockUser.
+func ResetUserPin(user *models.User, outbox ...models.OutboxMessage) error {
+	walletUnlock, unlocked, err := unlockMessages(user, "pin_reset")
+	if err != nil {
+		return err
+	}
+	wasLocked, err := user.ResetUserPin([]models.OutboxMessage{walletUnlock, unlocked}, outbox...)
+	if err != nil || !wasLocked {
+		return err
+	}
+	deliverWalletUnlock(user, walletUnlock)
+	return nil
+}
+
+// unlockMessages builds the wallet unlock command and the unlocked event, mirroring the lock
+func unlockMessages(user *models.User, reason string) (models.OutboxMessage, models.OutboxMessage, error) {
+	walletUnlock := NewCommandMessage(subject.SubjectWalletUnlock, user.ID.String())
+	unlocked, err := NewEventMessage(UserUnlocked{UserID: user.ID, Reason: reason})
+	return walletUnlock, unlocked, err
+}
+
+// deliverWalletUnlock unlocks the wallet right away when possible, otherwise the outbox relay does
+func deliverWalletUnlock(user *models.User, walletUnlock models.OutboxMessage) {
+	if _, err := DeliverCommand(walletUnlock); err != nil {
+		log.Printf("Wallet unlock for user %s deferred to the outbox relay: %v\n", user.ID, err)
+	}
+}
+
+// StartLockoutSweeper unlocks the accounts whose temporary lock has expired, so that their wallet
+// is unlocked even if the user does not sign in
+func StartLockoutSweeper() {
+	go func() {
+		for range time.Tick(lockoutSweepInterval) {
+			users, err := models.GetExpiredLockedUsers(lockoutSweepBatch)
+			if err != nil {
+				log.Printf("Error listing expired locks: %v\n", err)
+				continue
+			}
+			for i := range users {
+				if err := UnlockExpiredUser(&users[i]); err != nil {
+					log.Printf("Error unlocking user %s: %v\n", users[i].ID, err)
+				}
+			}
+		}
+	}()
+}
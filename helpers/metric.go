@@ -28,7 +28,104 @@ var HttpRequestErrors = prometheus.NewCounterVec(
 	[]string{"path", "method"},
 )
 
+// WalletBreakerState is a gauge for the wallet circuit breaker state: 0 closed, 1 half open, 2 open
+var WalletBreakerState = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "wallet_circuit_breaker_state",
+		Help: "State of the wallet service circuit breaker (0 closed, 1 half open, 2 open)",
+		ConstLabels: map[string]string{
+			"service": "Auth Service",
+		},
+	},
+)
+
+// DegradedLoginsTotal is a counter for logins completed without the wallet
+var DegradedLoginsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "degraded_logins_total",
+		Help: "Total number of logins completed while the wallet service was unavailable",
+		ConstLabels: map[string]string{
+			"service": "Auth Service",
+		},
+	},
+)
+
+// RateLimitedTotal is a counter for requests rejected by the rate limiter
+var RateLimitedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limited_requests_total",
+		Help: "Total number of requests rejected by the rate limiter",
+		ConstLabels: map[string]string{
+			"service": "Auth Service",
+		},
+	},
+	[]string{"route", "key"},
+)
+
+// StuffingDetectionsTotal is a counter for credential stuffing detections
+var StuffingDetectionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "credential_stuffing_detections_total",
+		Help: "Total number of credential stuffing detections by dimension and action",
+		ConstLabels: map[string]string{
+			"service": "Auth Service",
+		},
+	},
+	[]string{"dimension", "action"},
+)
+
+// StuffingChallengesTotal is a counter for login requests blocked or challenged by the credential stuffing detector
+var StuffingChallengesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "credential_stuffing_challenges_total",
+		Help: "Total number of login requests blocked or challenged because of credential stuffing",
+		ConstLabels: map[string]string{
+			"service": "Auth Service",
+		},
+	},
+	[]string{"action"},
+)
+
+// HashQueueDepth is a gauge for the PIN hashes waiting for a worker
+var HashQueueDepth = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "pin_hash_queue_depth",
+		Help: "Number of PIN hashes waiting for a hashing worker",
+		ConstLabels: map[string]string{
+			"service": "Auth Service",
+		},
+	},
+)
+
+// HashDuration is a histogram for the duration of PIN hashes and verifications
+var HashDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "pin_hash_duration_seconds",
+		Help:    "Duration of PIN hashes and verifications, without the time spent in the queue",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+		ConstLabels: map[string]string{
+			"service": "Auth Service",
+		},
+	},
+	[]string{"operation"},
+)
+
+// HashRejectedTotal is a counter for PIN hashes rejected because the hashing pool was busy
+var HashRejectedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pin_hash_rejected_total",
+		Help: "Total number of PIN hashes rejected because the queue was full or its deadline passed",
+		ConstLabels: map[string]string{
+			"service": "Auth Service",
+		},
+	},
+	[]string{"reason"},
+)
+
 // CollectHttpMetrics collects metrics from the HTTP requests
 func CollectHttpMetrics() {
-	prometheus.MustRegister(HttpRequestsTotal, HttpRequestErrors)
+	prometheus.MustRegister(
+		HttpRequestsTotal, HttpRequestErrors, WalletBreakerState, DegradedLoginsTotal, RateLimitedTotal,
+		StuffingDetectionsTotal, StuffingChallengesTotal, HashQueueDepth, HashDuration, HashRejectedTotal,
+	)
 }
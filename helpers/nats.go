@@ -2,11 +2,9 @@ package helpers
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"github.com/emmadal/feeti-auth/models"
-	"github.com/emmadal/feeti-module/subject"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
 	"log"
 	"os"
 	"sync"
@@ -14,11 +12,11 @@ import (
 )
 
 var (
-	nc            *nats.Conn
-	once          sync.Once
-	subscriptions []*nats.Subscription
-	subsMutex     sync.Mutex
-	initDone      sync.WaitGroup
+	nc        *nats.Conn
+	once      sync.Once
+	services  []micro.Service
+	subsMutex sync.Mutex
+	initDone  sync.WaitGroup
 )
 
 // NatsConfig holds the configuration options for NATS
@@ -27,6 +25,7 @@ type NatsConfig struct {
 	MaxReconnects int
 	ReconnectWait time.Duration
 	Replicas      int
+	QueueGroup    string
 }
 
 // ResponsePayload represents the standard response structure
@@ -36,10 +35,12 @@ type ResponsePayload struct {
 	Error   string `json:"error,omitempty"`
 }
 
-// RequestPayload represents the standard request structure
+// RequestPayload represents the standard request structure.
+// Timeout defaults to NATS_REQUEST_TIMEOUT.
 type RequestPayload struct {
-	Data    string `json:"data"`
-	Subject string `json:"subject"`
+	Data    string        `json:"data"`
+	Subject string        `json:"subject"`
+	Timeout time.Duration `json:"-"`
 }
 
 // defaultNatsConfig returns default configuration for NATS
@@ -48,11 +49,16 @@ func defaultNatsConfig() NatsConfig {
 	if natsURL == "" {
 		natsURL = nats.DefaultURL
 	}
+	queueGroup := os.Getenv("NATS_QUEUE_GROUP")
+	if queueGroup == "" {
+		queueGroup = "auth"
+	}
 	return NatsConfig{
 		URL:           natsURL,
 		MaxReconnects: 60,
 		ReconnectWait: 5 * time.Second,
 		Replicas:      1,
+		QueueGroup:    queueGroup,
 	}
 }
 
@@ -100,41 +106,36 @@ func NatsConnect() error {
 			return
 		}
 		log.Println("Successfully connected to NATS")
+		SetWalletClient(newWalletClient(nc))
 
-		// Only start subscribers if everything is set up correctly
-		// Use a WaitGroup to track when all subscriptions are ready
-		var subWg sync.WaitGroup
-		subWg.Add(1) // We have 1 subscription
-
+		// Only start the service if everything is set up correctly
 		go func() {
-			// Catch subscription panics to prevent goroutine crashes
+			// Catch service panics to prevent goroutine crashes
 			defer func() {
 				if r := recover(); r != nil {
-					log.Printf("Recovered from panic in NATS subscriptions: %v\n", r)
+					log.Printf("Recovered from panic in NATS service: %v\n", r)
 				}
 
 				// Signal that initialization has completed
 				initDone.Done()
 			}()
 
-			// Start all subscription handlers
-			err1 := subscribeToGetUser(&subWg)
+			// Create the event stream before serving requests that publish events
+			if err := setupEventStream(config); err != nil {
+				log.Printf("Failed to set up event stream: %v\n", err)
+			}
 
-			// Wait for all subscriptions to be ready
-			subWg.Wait()
+			// Share rate limits between replicas
+			if err := setupRateLimitStore(config); err != nil {
+				log.Printf("Failed to set up rate limit store: %v\n", err)
+			}
 
-			// Check for errors
-			for i, err := range []error{err1} {
-				if err != nil {
-					topic := ""
-					switch i {
-					case 0:
-						topic = subject.SubjectUserGet
-					}
-					log.Printf("Failed to subscribe to %s: %v\n", topic, err)
-				}
+			// Start the service and all its endpoints
+			if err := startAuthService(config); err != nil {
+				log.Printf("Failed to start NATS service: %v\n", err)
+				return
 			}
-			log.Println("All NATS subscriptions established")
+			log.Println("All NATS endpoints established")
 		}()
 	})
 
@@ -151,24 +152,22 @@ func DrainNatsConnection(ctx context.Context) error {
 	done := make(chan error, 1)
 
 	go func() {
-		log.Println("Draining NATS connection and unsubscribing from all subjects...")
+		log.Println("Stopping NATS services and draining connection...")
 
-		// Lock the subscription list
+		// Lock the service list
 		subsMutex.Lock()
 
-		// Unsubscribe from each subscription
-		for _, sub := range subscriptions {
-			if sub != nil {
-				if err := sub.Unsubscribe(); err != nil {
-					log.Printf("Error unsubscribing from %s: %v", sub.Subject, err)
-				} else {
-					log.Printf("Unsubscribed from %s", sub.Subject)
-				}
+		// Stop each service, which drains its endpoint subscriptions
+		for _, svc := range services {
+			if err := svc.Stop(); err != nil {
+				log.Printf("Error stopping service %s: %v", svc.Info().Name, err)
+			} else {
+				log.Printf("Stopped service %s", svc.Info().Name)
 			}
 		}
 
-		// Clear the subscription list
-		subscriptions = nil
+		// Clear the service list
+		services = nil
 		subsMutex.Unlock()
 
 		// Drain the connection
@@ -187,108 +186,42 @@ func DrainNatsConnection(ctx context.Context) error {
 	}
 }
 
-// RegisterSubscription adds a subscription to the tracked list
-func RegisterSubscription(sub *nats.Subscription) {
-	if sub == nil {
+// RegisterSubscription adds a service to the tracked list so that it is stopped on shutdown
+func RegisterSubscription(svc micro.Service) {
+	if svc == nil {
 		return
 	}
 
 	subsMutex.Lock()
 	defer subsMutex.Unlock()
 
-	subscriptions = append(subscriptions, sub)
-	log.Printf("Registered subscription on subject: %s", sub.Subject)
-}
-
-// subscribeToGetUser subscribes to the "wallet.get.user" subject
-func subscribeToGetUser(wg *sync.WaitGroup) error {
-	defer wg.Done()
-
-	// Subscribe to the subjectAuth subject
-	sub, err := nc.Subscribe(subject.SubjectUserGet, func(msg *nats.Msg) {
-		startTime := time.Now()
-		log.Printf("Received message [%s] on subject %s\n", string(msg.Data), msg.Subject)
-
-		// Add recovery to prevent crashes
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("Recovered from panic in wallet.create handler: %v\n", r)
-				sendResponse(msg, ResponsePayload{
-					Success: false,
-					Error:   fmt.Sprintf("Internal server error: %v", r),
-				})
-			}
-		}()
-
-		// Get user by phone number
-		phoneNumber := string(msg.Data)
-		modelUser := models.User{PhoneNumber: phoneNumber}
-		user, err := modelUser.GetUserByPhone()
-		if err != nil {
-			log.Printf("Failed to get user by phone number [%s]: %v\n", phoneNumber, err)
-			sendResponse(msg, ResponsePayload{
-				Success: false,
-				Error:   fmt.Sprintf("Failed to get user by phone number [%s]: %v", phoneNumber, err),
-			})
-			return
-		}
-		log.Printf("Got user by phone number [%s] in %v\n", phoneNumber, time.Since(startTime))
-
-		// Send success response
-		sendResponse(msg, ResponsePayload{
-			Success: true,
-			Data:    user,
-		})
-	})
-
-	if err != nil {
-		return fmt.Errorf("failed to subscribe to %s: %w", subject.SubjectUserGet, err)
+	services = append(services, svc)
+	info := svc.Info()
+	for _, endpoint := range info.Endpoints {
+		log.Printf("Registered endpoint %s on subject %s (queue group %s)", endpoint.Name, endpoint.Subject, endpoint.QueueGroup)
 	}
-
-	// Keep subscription active - don't auto-unsubscribe
-	if err := sub.SetPendingLimits(-1, -1); err != nil {
-		log.Printf("Failed to set pending limits for %s: %v\n", subject.SubjectUserGet, err)
-	}
-
-	// Register this subscription for cleanup
-	RegisterSubscription(sub)
-
-	return nil
 }
 
-// sendResponse sends a structured response to the NATS message
-func sendResponse(msg *nats.Msg, payload ResponsePayload) {
-	// If there's no reply subject, we can't respond
-	if msg.Reply == "" {
-		log.Println("No reply subject in message, cannot respond")
-		return
-	}
-
-	// Marshal the response payload to JSON
-	response, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Error marshaling response: %v\n", err)
-		// Try to send a simplified error message
-		errorMsg := []byte(`{"success":false,"error":"Failed to marshal response"}`)
-		if pubErr := nc.Publish(msg.Reply, errorMsg); pubErr != nil {
-			log.Printf("Failed to publish error response: %v\n", pubErr)
-		}
-		return
-	}
-
-	// Publish the response
-	if err := nc.Publish(msg.Reply, response); err != nil {
-		log.Printf("Failed to publish response: %v\n", err)
-	} else {
-		log.Printf("Response sent to %s: %t\n", msg.Reply, payload.Success)
+// requestTimeout returns the default timeout of NATS requests, from NATS_REQUEST_TIMEOUT
+func requestTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(os.Getenv("NATS_REQUEST_TIMEOUT")); err == nil && timeout > 0 {
+		return timeout
 	}
+	return time.Second
 }
 
 // PublishEvent sends a request to the NATS server
 func (r *RequestPayload) PublishEvent() (*nats.Msg, error) {
-	msg, err := nc.Request(r.Subject, []byte(r.Data), time.Second)
+	if nc == nil {
+		return nil, fmt.Errorf("unable to publish message to %s: not connected", r.Subject)
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = requestTimeout()
+	}
+	msg, err := nc.Request(r.Subject, []byte(r.Data), timeout)
 	if err != nil {
-		return nil, fmt.Errorf("unable to publish message to create wallet: %v", err)
+		return nil, fmt.Errorf("unable to publish message to %s: %v", r.Subject, err)
 	}
 	return msg, nil
 }
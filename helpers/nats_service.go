@@ -0,0 +1,372 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/emmadal/feeti-module/subject"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+const (
+	ServiceName    = "feeti-auth"
+	ServiceVersion = "1.0.0"
+)
+
+// SubjectTokenIntrospect is the subject other services use to validate an access token
+const SubjectTokenIntrospect = "auth.token.introspect"
+
+// SubjectPinVerify is the subject other services use to confirm a user's PIN before a sensitive operation
+const SubjectPinVerify = "auth.pin.verify"
+
+// IntrospectRequest is the payload of a token introspection request
+type IntrospectRequest struct {
+	Token string `json:"token"`
+}
+
+// IntrospectResponse describes an access token or a step-up token. Only Active is set for inactive tokens.
+// Duress is set for a session opened with the duress PIN, whose user acts under coercion, and for a step-up token
+// issued for the duress PIN. It is never carried by the tokens themselves.
+type IntrospectResponse struct {
+	Active    bool      `json:"active"`
+	UserID    uuid.UUID `json:"user_id,omitzero"`
+	SessionID uuid.UUID `json:"session_id,omitzero"`
+	Duress    bool      `json:"duress,omitempty"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	ExpiresAt int64     `json:"exp,omitempty"`
+}
+
+// PinVerifyRequest is the payload of a PIN verification request
+type PinVerifyRequest struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Pin       string    `json:"pin"`
+	IPAddress string    `json:"ip_address,omitempty"` // address of the end user, for the failure history
+}
+
+// PinVerifyResponse carries the step-up token to attach to the operation. It is the same for the duress PIN:
+// the service introspects the token to know whether the operation must look successful but be restricted.
+type PinVerifyResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// serviceEndpoint is an endpoint of the auth NATS service
+type serviceEndpoint struct {
+	Name    string
+	Subject string
+	Handler func(req micro.Request)
+}
+
+// serviceEndpoints lists the endpoints served by the auth service
+func serviceEndpoints() []serviceEndpoint {
+	return []serviceEndpoint{
+		{Name: "user-get", Subject: subject.SubjectUserGet, Handler: handleGetUser},
+		{Name: "token-introspect", Subject: SubjectTokenIntrospect, Handler: handleIntrospectToken},
+		{Name: "pin-verify", Subject: SubjectPinVerify, Handler: handleVerifyPin},
+	}
+}
+
+// startAuthService registers the auth service and its endpoints on a queue group,
+// so that a single replica answers each request. The service answers PING, INFO and STATS for discovery.
+func startAuthService(config NatsConfig) error {
+	svc, err := micro.AddService(nc, micro.Config{
+		Name:        ServiceName,
+		Version:     ServiceVersion,
+		Description: "Feeti authentication service",
+		QueueGroup:  config.QueueGroup,
+		ErrorHandler: func(svc micro.Service, natsErr *micro.NATSError) {
+			log.Printf("NATS service error on subject %s: %s\n", natsErr.Subject, natsErr.Description)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add service %s: %w", ServiceName, err)
+	}
+
+	for _, endpoint := range serviceEndpoints() {
+		err := svc.AddEndpoint(
+			endpoint.Name,
+			micro.HandlerFunc(recoverHandler(endpoint.Subject, endpoint.Handler)),
+			micro.WithEndpointSubject(endpoint.Subject),
+		)
+		if err != nil {
+			_ = svc.Stop()
+			return fmt.Errorf("failed to add endpoint %s: %w", endpoint.Subject, err)
+		}
+	}
+
+	// Register this service for cleanup
+	RegisterSubscription(svc)
+
+	return nil
+}
+
+// recoverHandler adds recovery to a handler to prevent crashes
+func recoverHandler(subject string, handler func(req micro.Request)) func(req micro.Request) {
+	return func(req micro.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Recovered from panic in %s handler: %v\n", subject, r)
+				sendError(req, http.StatusInternalServerError, "Internal server error")
+			}
+		}()
+		handler(req)
+	}
+}
+
+// handleGetUser answers "user.get" requests with the fields granted to the caller
+func handleGetUser(req micro.Request) {
+	startTime := time.Now()
+	log.Printf("Received message on subject %s\n", req.Subject())
+
+	// Only allowlisted services may read users, and only their fields
+	caller := CallerIdentity(nats.Header(req.Headers()))
+	fields, allowed := UserGetCallers()[caller]
+	if !allowed {
+		log.Printf("Rejected %s request from unknown caller [%s]\n", subject.SubjectUserGet, caller)
+		sendError(req, http.StatusForbidden, "Unauthorized caller")
+		return
+	}
+
+	// Get user by phone number
+	phoneNumber := string(req.Data())
+	modelUser := models.User{PhoneNumber: phoneNumber}
+	user, err := modelUser.GetUserByPhone()
+	if err != nil {
+		log.Printf("Failed to get user by phone number: %v\n", err)
+		sendError(req, http.StatusNotFound, "User not found")
+		return
+	}
+	log.Printf("Got user for [%s] in %v\n", caller, time.Since(startTime))
+
+	// Send success response
+	sendResponse(req, ResponsePayload{
+		Success: true,
+		Data:    ProjectUser(user, fields),
+	})
+}
+
+// handleIntrospectToken answers "auth.token.introspect" requests
+func handleIntrospectToken(req micro.Request) {
+	var request IntrospectRequest
+	if err := json.Unmarshal(req.Data(), &request); err != nil || request.Token == "" {
+		sendError(req, http.StatusBadRequest, "Invalid introspection request")
+		return
+	}
+
+	result, err := IntrospectToken(request.Token, CallerIdentity(nats.Header(req.Headers())))
+	if err != nil {
+		log.Printf("Failed to introspect token: %v\n", err)
+		sendError(req, http.StatusInternalServerError, "Unable to introspect token")
+		return
+	}
+
+	// Send success response
+	sendResponse(req, ResponsePayload{
+		Success: true,
+		Data:    result,
+	})
+}
+
+// handleVerifyPin answers "auth.pin.verify" requests. Failed attempts fall under the lockout policy
+// of login, so the account is locked the same way.
+func handleVerifyPin(req micro.Request) {
+	caller := CallerIdentity(nats.Header(req.Headers()))
+	if !PinVerifyCallers()[caller] {
+		log.Printf("Rejected %s request from unknown caller [%s]\n", SubjectPinVerify, caller)
+		sendError(req, http.StatusForbidden, "Unauthorized caller")
+		return
+	}
+
+	var request PinVerifyRequest
+	if err := json.Unmarshal(req.Data(), &request); err != nil || request.UserID == uuid.Nil || !GetPinPolicy().ValidPin(request.Pin) {
+		sendError(req, http.StatusBadRequest, "Invalid PIN verification request")
+		return
+	}
+
+	user, err := models.GetUserByID(request.UserID)
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			sendError(req, http.StatusNotFound, "User not found")
+			return
+		}
+		log.Printf("Failed to get user by id: %v\n", err)
+		sendError(req, http.StatusInternalServerError, "Unable to verify PIN")
+		return
+	}
+
+	duress, err := CheckUserPin(context.Background(), user, request.Pin, request.IPAddress, "pin_verify")
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrAccountLocked):
+			sendError(req, http.StatusLocked, "Account locked")
+		case errors.Is(err, ErrPinThrottled):
+			sendError(req, http.StatusTooManyRequests, err.Error())
+		case errors.Is(err, ErrInvalidPin):
+			sendError(req, http.StatusUnauthorized, "Invalid PIN")
+		case errors.Is(err, ErrHashingBusy):
+			sendError(req, http.StatusServiceUnavailable, "Service busy. Please try again")
+		default:
+			log.Printf("Failed to verify PIN: %v\n", err)
+			sendError(req, http.StatusInternalServerError, "Unable to verify PIN")
+		}
+		recordPinVerify(user, caller, false)
+		return
+	}
+
+	tokenID := uuid.New()
+	token, expiresAt, err := GenerateStepUpToken(tokenID, user.ID, caller)
+	if err != nil {
+		log.Printf("Failed to generate step-up token: %v\n", err)
+		sendError(req, http.StatusInternalServerError, "Unable to verify PIN")
+		return
+	}
+	stepUp := models.StepUpToken{ID: tokenID, UserID: user.ID, Audience: caller, Duress: duress, ExpiresAt: expiresAt}
+	if err := stepUp.CreateStepUpToken(); err != nil {
+		log.Printf("Failed to record step-up token: %v\n", err)
+		sendError(req, http.StatusInternalServerError, "Unable to verify PIN")
+		return
+	}
+	recordPinVerify(user, caller, true)
+	if duress {
+		RecordDuress(user, uuid.Nil, request.IPAddress, caller)
+	}
+
+	// Send success response
+	sendResponse(req, ResponsePayload{
+		Success: true,
+		Data:    PinVerifyResponse{Token: token, ExpiresAt: expiresAt.Unix()},
+	})
+}
+
+// recordPinVerify records a PIN verification in the auth logs
+func recordPinVerify(user *models.User, caller string, verified bool) {
+	go func() {
+		metadata, _ := json.Marshal(map[string]any{"source": caller, "verified": verified})
+		authLog := models.AuthLog{
+			UserID:      user.ID,
+			PhoneNumber: user.PhoneNumber,
+			DeviceToken: user.DeviceToken,
+			Activity:    "pin_verify",
+			Metadata:    string(metadata),
+		}
+		if err := authLog.CreateAuthLog(); err != nil {
+			log.Printf("Error creating auth log: %v\n", err)
+		}
+	}()
+}
+
+// IntrospectToken checks the token signature, its session and the state of the account.
+// A step-up token is only described to the service it was issued for, the caller, and only once.
+// An error is only returned when the state cannot be determined.
+func IntrospectToken(token, caller string) (IntrospectResponse, error) {
+	inactive := IntrospectResponse{Active: false}
+
+	claims, err := VerifyAccessToken(token)
+	if err != nil {
+		if stepUp, err := VerifyStepUpToken(token); err == nil {
+			return introspectStepUpToken(stepUp, caller)
+		}
+		return inactive, nil
+	}
+
+	active, duress, err := CheckSession(claims.SessionID, claims.UserID)
+	if err != nil || !active {
+		return inactive, err
+	}
+	if active, err := isUserActive(claims.UserID); err != nil || !active {
+		return inactive, err
+	}
+
+	return IntrospectResponse{
+		Active:    true,
+		UserID:    claims.UserID,
+		SessionID: claims.SessionID,
+		Duress:    duress,
+		Scopes:    strings.Fields(claims.Scope),
+		ExpiresAt: claims.ExpiresAt.Unix(),
+	}, nil
+}
+
+// introspectStepUpToken describes a step-up token from its record, and marks it used.
+// A token introspected before is inactive.
+func introspectStepUpToken(claims *Claims, caller string) (IntrospectResponse, error) {
+	inactive := IntrospectResponse{Active: false}
+	if caller == "" || !slices.Contains(claims.Audience, caller) {
+		return inactive, nil
+	}
+	tokenID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return inactive, nil
+	}
+
+	// The token is used up, so that it cannot be replayed for another operation
+	stepUp, err := models.UseStepUpToken(tokenID, claims.UserID, caller)
+	if err != nil {
+		if errors.Is(err, models.ErrStepUpTokenNotFound) {
+			return inactive, nil
+		}
+		return inactive, err
+	}
+	if active, err := isUserActive(claims.UserID); err != nil || !active {
+		return inactive, err
+	}
+
+	return IntrospectResponse{
+		Active:    true,
+		UserID:    claims.UserID,
+		Duress:    stepUp.Duress,
+		Scopes:    strings.Fields(claims.Scope),
+		ExpiresAt: claims.ExpiresAt.Unix(),
+	}, nil
+}
+
+// isUserActive reports whether the account exists, is active and is not locked
+func isUserActive(userID uuid.UUID) (bool, error) {
+	// GetUserByID only returns active accounts
+	user, err := models.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return !user.IsLocked(), nil
+}
+
+// sendResponse sends a structured response to the request
+func sendResponse(req micro.Request, payload ResponsePayload) {
+	// Marshal the response payload to JSON
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling response: %v\n", err)
+		sendError(req, http.StatusInternalServerError, "Failed to marshal response")
+		return
+	}
+
+	// Publish the response
+	if err := req.Respond(response); err != nil {
+		log.Printf("Failed to publish response: %v\n", err)
+	} else {
+		log.Printf("Response sent to %s: %t\n", req.Reply(), payload.Success)
+	}
+}
+
+// sendError sends a failed ResponsePayload with the service error headers,
+// so that the error is counted in the endpoint stats
+func sendError(req micro.Request, code int, message string) {
+	response, _ := json.Marshal(ResponsePayload{Success: false, Error: message})
+	if err := req.Error(strconv.Itoa(code), message, response); err != nil {
+		log.Printf("Failed to publish error response: %v\n", err)
+	}
+}
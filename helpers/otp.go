@@ -0,0 +1,245 @@
+package helpers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/emmadal/feeti-module/subject"
+	"github.com/google/uuid"
+)
+
+const (
+	OTPLength             = 5
+	defaultOTPTTL         = 5 * time.Minute
+	defaultOTPMaxAttempts = 3
+)
+
+// OTPMessage is the message handed to an OTPSender
+type OTPMessage struct {
+	PhoneNumber string `json:"phone_number"`
+	Code        string `json:"code,omitempty"`
+	Purpose     string `json:"purpose"`
+	ExpiresAt   string `json:"expires_at"`
+}
+
+// OTPSender delivers an OTP to the owner of a phone number
+type OTPSender interface {
+	Send(message OTPMessage) error
+}
+
+// ConsoleOTPSender writes OTPs to the service logs, for local development only
+type ConsoleOTPSender struct{}
+
+// FileOTPSender appends OTPs as JSON lines to a file, for local development only
+type FileOTPSender struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// NatsOTPSender forwards OTPs to the notification service
+type NatsOTPSender struct{}
+
+var (
+	otpSender     OTPSender
+	otpSenderOnce sync.Once
+)
+
+// Send logs the OTP message
+func (s *ConsoleOTPSender) Send(message OTPMessage) error {
+	log.Printf("OTP [%s] for %s: %s (expires at %s)\n", message.Purpose, message.PhoneNumber, message.Code, message.ExpiresAt)
+	return nil
+}
+
+// Send appends the OTP message to the file
+func (s *FileOTPSender) Send(message OTPMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(message)
+}
+
+// Send publishes the OTP message to the notification service
+func (s *NatsOTPSender) Send(message OTPMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	pMessage := RequestPayload{
+		Subject: subject.SubjectOTPCreate,
+		Data:    string(data),
+	}
+	_, err = pMessage.PublishEvent()
+	return err
+}
+
+// GetOTPSender returns the sender selected by OTP_SENDER (nats, file or console)
+func GetOTPSender() OTPSender {
+	otpSenderOnce.Do(func() {
+		switch os.Getenv("OTP_SENDER") {
+		case "file":
+			path := os.Getenv("OTP_FILE_PATH")
+			if path == "" {
+				path = "otp.log"
+			}
+			otpSender = &FileOTPSender{Path: path}
+		case "console":
+			otpSender = &ConsoleOTPSender{}
+		default:
+			otpSender = &NatsOTPSender{}
+		}
+	})
+	return otpSender
+}
+
+// GenerateOTP generates a random numeric code of OTPLength digits
+func GenerateOTP() (string, error) {
+	limit := big.NewInt(1)
+	for i := 0; i < OTPLength; i++ {
+		limit.Mul(limit, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", OTPLength, n.Int64()), nil
+}
+
+// CheckOTPSecret checks that OTP_SECRET is set and is not the JWT_KEY token secret
+func CheckOTPSecret() error {
+	secret := os.Getenv("OTP_SECRET")
+	if secret == "" {
+		return fmt.Errorf("OTP_SECRET is not set")
+	}
+	if secret == os.Getenv("JWT_KEY") {
+		return fmt.Errorf("OTP_SECRET must differ from JWT_KEY")
+	}
+	return nil
+}
+
+// HashOTP hashes an OTP bound to a phone number so stored codes cannot be replayed for another number
+func HashOTP(phoneNumber, code string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("OTP_SECRET")))
+	mac.Write([]byte(phoneNumber + ":" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// OTPTTL returns the OTP lifetime from OTP_TTL
+func OTPTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("OTP_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return defaultOTPTTL
+}
+
+// OTPMaxAttempts returns the number of verification attempts allowed from OTP_MAX_ATTEMPTS
+func OTPMaxAttempts() int {
+	if attempts, err := strconv.Atoi(os.Getenv("OTP_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		return attempts
+	}
+	return defaultOTPMaxAttempts
+}
+
+// createOTP stores a new OTP for the phone number and purpose and returns it with its code
+func createOTP(phoneNumber, purpose string) (*models.OTP, string, error) {
+	code, err := GenerateOTP()
+	if err != nil {
+		return nil, "", err
+	}
+
+	otp := &models.OTP{
+		PhoneNumber: phoneNumber,
+		Purpose:     purpose,
+		CodeHash:    HashOTP(phoneNumber, code),
+		MaxAttempts: OTPMaxAttempts(),
+		ExpiresAt:   time.Now().Add(OTPTTL()),
+	}
+	if err := otp.CreateOTP(); err != nil {
+		return nil, "", err
+	}
+	return otp, code, nil
+}
+
+// IssueOTP creates an OTP for the phone number and purpose and sends it with the configured sender
+func IssueOTP(phoneNumber, purpose string) (*models.OTP, error) {
+	otp, code, err := createOTP(phoneNumber, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	err = GetOTPSender().Send(OTPMessage{
+		PhoneNumber: phoneNumber,
+		Code:        code,
+		Purpose:     purpose,
+		ExpiresAt:   otp.ExpiresAt.Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return otp, nil
+}
+
+// SendAccountExistsNotice tells the owner of a registered phone number that someone tried to register it.
+// The notice goes through the OTP channel without a code. Its record counts toward the registration rate limit,
+// so that registering a known number is limited like registering a new one.
+func SendAccountExistsNotice(phoneNumber string) (*models.OTP, error) {
+	otp, _, err := createOTP(phoneNumber, models.OTPPurposeAccountExists)
+	if err != nil {
+		return nil, err
+	}
+
+	err = GetOTPSender().Send(OTPMessage{
+		PhoneNumber: phoneNumber,
+		Purpose:     models.OTPPurposeAccountExists,
+		ExpiresAt:   otp.ExpiresAt.Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return otp, nil
+}
+
+// IssueDecoyOTP stores an OTP that is never sent, for a phone number the request cannot go on with.
+// Such requests then get a key UID, whose confirmation fails and runs out of attempts like the others.
+func IssueDecoyOTP(phoneNumber, purpose string) (*models.OTP, error) {
+	otp, _, err := createOTP(phoneNumber, purpose)
+	return otp, err
+}
+
+// CheckOTP verifies and consumes the OTP bound to the key UID
+func CheckOTP(keyUID uuid.UUID, phoneNumber, purpose, code string) error {
+	otp := &models.OTP{
+		KeyUID:      keyUID,
+		PhoneNumber: phoneNumber,
+		Purpose:     purpose,
+		CodeHash:    HashOTP(phoneNumber, code),
+	}
+	return otp.VerifyOTP()
+}
+
+// MatchOTP verifies the OTP bound to the key UID without consuming it. A wrong code still counts as an attempt.
+func MatchOTP(keyUID uuid.UUID, phoneNumber, purpose, code string) error {
+	otp := &models.OTP{
+		KeyUID:      keyUID,
+		PhoneNumber: phoneNumber,
+		Purpose:     purpose,
+		CodeHash:    HashOTP(phoneNumber, code),
+	}
+	return otp.MatchOTP()
+}
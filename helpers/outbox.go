@@ -0,0 +1,151 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultOutboxRelayInterval = time.Second
+	defaultOutboxMaxAttempts   = 20
+	outboxBatchSize            = 50
+	outboxLease                = 2 * time.Minute // longer than a batch of commands timing out
+	outboxMaxBackoff           = 5 * time.Minute
+	outboxRetention            = 7 * 24 * time.Hour
+)
+
+// NewEventMessage builds the outbox message of an account lifecycle event.
+// The message ID is the event ID, which JetStream uses to drop duplicate deliveries.
+func NewEventMessage(data UserEvent) (models.OutboxMessage, error) {
+	event := NewEvent(data)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return models.OutboxMessage{}, err
+	}
+	return models.OutboxMessage{
+		ID:      event.ID,
+		Kind:    models.OutboxKindEvent,
+		Subject: event.Type,
+		Payload: payload,
+	}, nil
+}
+
+// NewCommandMessage builds the outbox message of a request to another service.
+// Commands may be delivered more than once, so the receiving service must handle them idempotently.
+func NewCommandMessage(subject, data string) models.OutboxMessage {
+	return models.OutboxMessage{
+		ID:      uuid.New(),
+		Kind:    models.OutboxKindCommand,
+		Subject: subject,
+		Payload: []byte(data),
+	}
+}
+
+// outboxRelayInterval returns the delay between relay passes, from OUTBOX_RELAY_INTERVAL
+func outboxRelayInterval() time.Duration {
+	if interval, err := time.ParseDuration(os.Getenv("OUTBOX_RELAY_INTERVAL")); err == nil && interval > 0 {
+		return interval
+	}
+	return defaultOutboxRelayInterval
+}
+
+// outboxMaxAttempts returns how many times a message is tried before it is left for inspection,
+// from OUTBOX_MAX_ATTEMPTS
+func outboxMaxAttempts() int {
+	if attempts, err := strconv.Atoi(os.Getenv("OUTBOX_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		return attempts
+	}
+	return defaultOutboxMaxAttempts
+}
+
+// outboxBackoff doubles the delay after each failed attempt, up to five minutes
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 10 {
+		return outboxMaxBackoff
+	}
+	return min(time.Second<<attempts, outboxMaxBackoff)
+}
+
+// newOutboxRelay returns a relay delivering messages with deliver
+func newOutboxRelay(deliver func(msg models.OutboxMessage) error) models.OutboxRelay {
+	return models.OutboxRelay{
+		BatchSize:   outboxBatchSize,
+		MaxAttempts: outboxMaxAttempts(),
+		Lease:       outboxLease,
+		Deliver:     deliver,
+		Backoff:     outboxBackoff,
+	}
+}
+
+// deliverOutboxMessage publishes an event, or sends a command and checks its reply
+func deliverOutboxMessage(msg models.OutboxMessage) error {
+	switch msg.Kind {
+	case models.OutboxKindEvent:
+		return publishEventPayload(msg.Subject, msg.ID.String(), msg.Payload)
+	case models.OutboxKindCommand:
+		_, err := sendCommand(msg)
+		return err
+	default:
+		return fmt.Errorf("unknown outbox message kind %s", msg.Kind)
+	}
+}
+
+// sendCommand sends a command and decodes the reply. A reply without success is an error.
+func sendCommand(msg models.OutboxMessage) (*ResponsePayload, error) {
+	request := RequestPayload{Subject: msg.Subject, Data: string(msg.Payload)}
+	resp, err := request.PublishEvent()
+	if err != nil {
+		return nil, err
+	}
+
+	var response ResponsePayload
+	if err := json.Unmarshal(resp.Data, &response); err != nil {
+		return nil, fmt.Errorf("malformed reply on %s: %w", msg.Subject, err)
+	}
+	if !response.Success {
+		return &response, fmt.Errorf("command %s rejected: %s", msg.Subject, response.Error)
+	}
+	return &response, nil
+}
+
+// DeliverCommand sends a command written to the outbox right away and returns the reply.
+// When it fails, the relay retries the command later.
+func DeliverCommand(msg models.OutboxMessage) (*ResponsePayload, error) {
+	var response *ResponsePayload
+	relay := newOutboxRelay(func(msg models.OutboxMessage) error {
+		var err error
+		response, err = sendCommand(msg)
+		return err
+	})
+	if err := relay.DeliverOutboxMessage(msg.ID); err != nil {
+		return response, err
+	}
+	return response, nil
+}
+
+// StartOutboxRelay relays pending outbox messages in the background.
+// Replicas compete for an advisory lock, so a single one relays at a time.
+func StartOutboxRelay() {
+	relay := newOutboxRelay(deliverOutboxMessage)
+	go func() {
+		lastPurge := time.Now()
+		for range time.Tick(outboxRelayInterval()) {
+			if _, err := relay.Relay(); err != nil {
+				log.Printf("Error relaying outbox: %v\n", err)
+			}
+			if time.Since(lastPurge) > time.Hour {
+				if err := models.PurgeOutbox(time.Now().Add(-outboxRetention)); err != nil {
+					log.Printf("Error purging outbox: %v\n", err)
+				}
+				lastPurge = time.Now()
+			}
+		}
+	}()
+}
@@ -1,41 +1,362 @@
 package helpers
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// HashPassword hashes a password using bcrypt
-func HashPassword(password string) (string, error) {
-	var cost int
-	if os.Getenv("GIN_MODE") == "release" {
-		cost = bcrypt.DefaultCost
-	} else {
-		cost = bcrypt.MinCost
+// Hash algorithms
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+const (
+	defaultArgon2Memory  = 64 * 1024 // KiB
+	defaultArgon2Time    = 3
+	defaultArgon2Threads = 2
+	argon2SaltLength     = 16
+	argon2KeyLength      = 32
+)
+
+// PasswordHashing is the policy new hashes are made with. Stored hashes made with another algorithm,
+// weaker parameters or without the current pepper are upgraded at the next successful login.
+//
+// Argon2id hashes use the PHC string format, with a "k" parameter identifying the pepper when there is one:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2,k=1a2b3c4d$<salt>$<hash>
+//
+// bcrypt hashes are never peppered. Hashes made with a previous pepper verify while it is in the keyring.
+type PasswordHashing struct {
+	Algorithm       string
+	Memory          uint32
+	Time            uint32
+	Threads         uint8
+	BcryptCost      int
+	pepper          []byte
+	pepperID        string
+	previousPeppers map[string][]byte // by pepper id
+}
+
+// ErrUnknownPepper is returned for a hash made with a pepper that is neither the current one nor a previous one.
+// The PIN cannot be checked, so it must not count as a wrong PIN.
+var ErrUnknownPepper = errors.New("pin hash made with an unknown pepper")
+
+var (
+	passwordHashing     *PasswordHashing
+	passwordHashingErr  error
+	passwordHashingOnce sync.Once
+	dummyHash           string
+	dummyHashMu         sync.Mutex
+)
+
+// LoadPasswordHashing reads the hashing policy from PIN_HASH_ALGORITHM, ARGON2_MEMORY, ARGON2_TIME,
+// ARGON2_THREADS and BCRYPT_COST, the pepper from the file in PIN_PEPPER_FILE and the peppers it replaced from
+// the comma-separated files in PIN_PEPPER_PREVIOUS.
+// It fails when a pepper file is set but cannot be read, since hashes made with it would not verify.
+func LoadPasswordHashing() error {
+	passwordHashingOnce.Do(func() {
+		hashing := &PasswordHashing{
+			Algorithm:  HashArgon2id,
+			Memory:     defaultArgon2Memory,
+			Time:       defaultArgon2Time,
+			Threads:    defaultArgon2Threads,
+			BcryptCost: bcrypt.DefaultCost,
+		}
+		if os.Getenv("PIN_HASH_ALGORITHM") == HashBcrypt {
+			hashing.Algorithm = HashBcrypt
+		}
+		if memory, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY"), 10, 32); err == nil && memory >= 8*1024 {
+			hashing.Memory = uint32(memory)
+		}
+		if t, err := strconv.ParseUint(os.Getenv("ARGON2_TIME"), 10, 32); err == nil && t > 0 {
+			hashing.Time = uint32(t)
+		}
+		if threads, err := strconv.ParseUint(os.Getenv("ARGON2_THREADS"), 10, 8); err == nil && threads > 0 {
+			hashing.Threads = uint8(threads)
+		}
+		if cost, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err == nil && cost >= bcrypt.DefaultCost && cost <= bcrypt.MaxCost {
+			hashing.BcryptCost = cost
+		}
+
+		if path := os.Getenv("PIN_PEPPER_FILE"); path != "" {
+			pepper, err := readPepper(path)
+			if err != nil {
+				passwordHashingErr = err
+				return
+			}
+			hashing.pepper, hashing.pepperID = pepper, pepperID(pepper)
+		}
+		for _, path := range strings.Split(os.Getenv("PIN_PEPPER_PREVIOUS"), ",") {
+			if path = strings.TrimSpace(path); path == "" {
+				continue
+			}
+			pepper, err := readPepper(path)
+			if err != nil {
+				passwordHashingErr = err
+				return
+			}
+			hashing.addPreviousPepper(pepper)
+		}
+		passwordHashing = hashing
+	})
+	return passwordHashingErr
+}
+
+// readPepper reads a pepper file
+func readPepper(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pepper file: %w", err)
+	}
+	pepper := []byte(strings.TrimSpace(string(data)))
+	if len(pepper) == 0 {
+		return nil, fmt.Errorf("pepper file %s is empty", path)
+	}
+	return pepper, nil
+}
+
+// pepperID returns the short id recorded in the hashes made with a pepper
+func pepperID(pepper []byte) string {
+	sum := sha256.Sum256(pepper)
+	return hex.EncodeToString(sum[:4])
+}
+
+// addPreviousPepper adds a pepper that hashes may still be made with to the keyring
+func (h *PasswordHashing) addPreviousPepper(pepper []byte) {
+	if h.previousPeppers == nil {
+		h.previousPeppers = make(map[string][]byte)
+	}
+	h.previousPeppers[pepperID(pepper)] = pepper
+}
+
+// currentHashing returns the hashing policy, loading it on first use
+func currentHashing() (*PasswordHashing, error) {
+	if err := LoadPasswordHashing(); err != nil {
+		return nil, err
+	}
+	return passwordHashing, nil
+}
+
+// HashPassword hashes a password with the current algorithm and pepper, on the hashing pool
+func HashPassword(ctx context.Context, password string) (string, error) {
+	hashing, err := currentHashing()
+	if err != nil {
+		return "", err
 	}
 	password = strings.TrimSpace(password)
 	if password == "" {
 		return "", fmt.Errorf("password cannot be empty")
 	}
-	encodedHash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
-	if err != nil {
-		return "", err
+
+	var encodedHash string
+	runErr := hashingPool().run(ctx, "hash", func() {
+		encodedHash, err = hashing.hash(password)
+	})
+	if runErr != nil {
+		return "", runErr
 	}
-	return string(encodedHash), nil
+	return encodedHash, err
 }
 
-// VerifyPassword verifies if a password matches the provided hash
-func VerifyPassword(password, encodedHash string) bool {
+// VerifyPassword verifies if a password matches the provided hash, on the hashing pool.
+// needsRehash is set on a match when the hash is older or weaker than the current policy.
+// An error is only returned when the PIN could not be checked, ErrUnknownPepper when its pepper is missing.
+func VerifyPassword(ctx context.Context, password, encodedHash string) (match bool, needsRehash bool, err error) {
 	password = strings.TrimSpace(password)
 	encodedHash = strings.TrimSpace(encodedHash)
 
 	if password == "" || encodedHash == "" {
-		return false
+		return false, false, nil
+	}
+	hashing, err := currentHashing()
+	if err != nil {
+		return false, false, err
+	}
+
+	var verifyErr error
+	err = hashingPool().run(ctx, "verify", func() {
+		match, needsRehash, verifyErr = hashing.verify(password, encodedHash)
+	})
+	if err != nil {
+		return false, false, err
+	}
+	return match, needsRehash, verifyErr
+}
+
+// VerifyDummyPassword compares a password with a throwaway hash made with the current policy.
+// It is called when there is no user to check against, so that an unknown phone number takes as long as a wrong PIN.
+func VerifyDummyPassword(ctx context.Context, password string) error {
+	hash, err := dummyPasswordHash(ctx)
+	if err != nil {
+		return err
+	}
+	_, _, err = VerifyPassword(ctx, password, hash)
+	return err
+}
+
+// dummyPasswordHash hashes the throwaway password once, retrying on the next call when the pool was busy
+func dummyPasswordHash(ctx context.Context) (string, error) {
+	dummyHashMu.Lock()
+	defer dummyHashMu.Unlock()
+
+	if dummyHash == "" {
+		hash, err := HashPassword(ctx, "dummy-pin")
+		if err != nil {
+			return "", err
+		}
+		dummyHash = hash
+	}
+	return dummyHash, nil
+}
+
+// hash hashes a trimmed password
+func (h *PasswordHashing) hash(password string) (string, error) {
+	if h.Algorithm == HashBcrypt {
+		encodedHash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(encodedHash), nil
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(peppered(password, h.pepper), salt, h.Time, h.Memory, h.Threads, argon2KeyLength)
+
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", h.Memory, h.Time, h.Threads)
+	if h.pepperID != "" {
+		params += ",k=" + h.pepperID
+	}
+	return fmt.Sprintf(
+		"$%s$v=%d$%s$%s$%s",
+		HashArgon2id, argon2.Version, params,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verify compares a trimmed password with a bcrypt or Argon2id hash.
+// It fails with ErrUnknownPepper when the hash was made with a pepper missing from the keyring.
+func (h *PasswordHashing) verify(password, encodedHash string) (match bool, needsRehash bool, err error) {
+	if !strings.HasPrefix(encodedHash, "$"+HashArgon2id+"$") {
+		if bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password)) != nil {
+			return false, false, nil
+		}
+		cost, err := bcrypt.Cost([]byte(encodedHash))
+		return true, h.Algorithm != HashBcrypt || err != nil || cost < h.BcryptCost, nil
+	}
+
+	hash, err := parseArgon2Hash(encodedHash)
+	if err != nil {
+		return false, false, nil
 	}
+	pepper, ok := h.pepperFor(hash.pepperID)
+	if !ok {
+		return false, false, fmt.Errorf("%w %s", ErrUnknownPepper, hash.pepperID)
+	}
+	key := argon2.IDKey(peppered(password, pepper), hash.salt, hash.time, hash.memory, hash.threads, uint32(len(hash.key)))
+	if subtle.ConstantTimeCompare(key, hash.key) != 1 {
+		return false, false, nil
+	}
+	return true, h.Algorithm != HashArgon2id ||
+		hash.memory < h.Memory ||
+		hash.time < h.Time ||
+		hash.pepperID != h.pepperID, nil
+}
+
+// pepperFor returns the pepper a hash was made with, nil for a hash without pepper
+func (h *PasswordHashing) pepperFor(id string) ([]byte, bool) {
+	switch {
+	case id == "":
+		return nil, true
+	case id == h.pepperID:
+		return h.pepper, true
+	}
+	pepper, ok := h.previousPeppers[id]
+	return pepper, ok
+}
 
-	err := bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password))
-	return err == nil
+// peppered returns the Argon2id input: the password, or its HMAC with the pepper when there is one
+func peppered(password string, pepper []byte) []byte {
+	if pepper == nil {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+type argon2Hash struct {
+	memory   uint32
+	time     uint32
+	threads  uint8
+	pepperID string
+	salt     []byte
+	key      []byte
+}
+
+// parseArgon2Hash parses an Argon2id PHC string
+func parseArgon2Hash(encodedHash string) (*argon2Hash, error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return nil, fmt.Errorf("invalid argon2id hash")
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, fmt.Errorf("unsupported argon2 version %s", parts[2])
+	}
+
+	var hash argon2Hash
+	for _, param := range strings.Split(parts[3], ",") {
+		name, value, _ := strings.Cut(param, "=")
+		switch name {
+		case "m":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid argon2id memory: %w", err)
+			}
+			hash.memory = uint32(n)
+		case "t":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid argon2id time: %w", err)
+			}
+			hash.time = uint32(n)
+		case "p":
+			n, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid argon2id threads: %w", err)
+			}
+			hash.threads = uint8(n)
+		case "k":
+			hash.pepperID = value
+		}
+	}
+	if hash.memory == 0 || hash.time == 0 || hash.threads == 0 {
+		return nil, fmt.Errorf("missing argon2id parameters")
+	}
+
+	var err error
+	if hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	if hash.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(hash.key) == 0 {
+		return nil, fmt.Errorf("invalid argon2id key")
+	}
+	return &hash, nil
 }
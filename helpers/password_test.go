@@ -0,0 +1,214 @@
+package helpers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestHashing returns a fast Argon2id policy, peppered when pepper is not empty
+func newTestHashing(pepper string) *PasswordHashing {
+	hashing := &PasswordHashing{
+		Algorithm:  HashArgon2id,
+		Memory:     8 * 1024,
+		Time:       1,
+		Threads:    1,
+		BcryptCost: bcrypt.MinCost,
+	}
+	if pepper != "" {
+		hashing.pepper = []byte(pepper)
+		hashing.pepperID = pepperID(hashing.pepper)
+	}
+	return hashing
+}
+
+// mustHash hashes a password or fails the test
+func mustHash(t *testing.T, hashing *PasswordHashing, password string) string {
+	t.Helper()
+	hash, err := hashing.hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestArgon2RoundTrip(t *testing.T) {
+	hashing := newTestHashing("")
+	hash := mustHash(t, hashing, "1234")
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=8192,t=1,p=1$") {
+		t.Fatalf("unexpected PHC string %q", hash)
+	}
+	if other := mustHash(t, hashing, "1234"); other == hash {
+		t.Error("expected a new salt for every hash")
+	}
+	if match, needsRehash, _ := hashing.verify("1234", hash); !match || needsRehash {
+		t.Errorf("got match %t, rehash %t, want a match without rehash", match, needsRehash)
+	}
+	if match, _, _ := hashing.verify("4321", hash); match {
+		t.Error("expected a wrong PIN not to match")
+	}
+}
+
+func TestPepperedHash(t *testing.T) {
+	hashing := newTestHashing("pepper")
+	hash := mustHash(t, hashing, "1234")
+
+	if !strings.Contains(hash, ",k="+hashing.pepperID+"$") {
+		t.Fatalf("expected the pepper id in %q", hash)
+	}
+	if match, needsRehash, _ := hashing.verify("1234", hash); !match || needsRehash {
+		t.Errorf("got match %t, rehash %t, want a match without rehash", match, needsRehash)
+	}
+
+	// Without the pepper of the hash, the PIN cannot be checked
+	if match, _, err := newTestHashing("other").verify("1234", hash); match || !errors.Is(err, ErrUnknownPepper) {
+		t.Errorf("got match %t, error %v, want ErrUnknownPepper for a hash made with another pepper", match, err)
+	}
+	if match, _, err := newTestHashing("").verify("1234", hash); match || !errors.Is(err, ErrUnknownPepper) {
+		t.Errorf("got match %t, error %v, want ErrUnknownPepper without the pepper", match, err)
+	}
+
+	// A hash from before the pepper matches and is upgraded
+	plain := mustHash(t, newTestHashing(""), "1234")
+	if match, needsRehash, _ := hashing.verify("1234", plain); !match || !needsRehash {
+		t.Errorf("got match %t, rehash %t, want a match with rehash", match, needsRehash)
+	}
+}
+
+func TestPreviousPepper(t *testing.T) {
+	old := mustHash(t, newTestHashing("old"), "1234")
+	hashing := newTestHashing("new")
+	hashing.addPreviousPepper([]byte("old"))
+
+	// A hash made with a previous pepper still verifies, and is upgraded to the current one
+	match, needsRehash, err := hashing.verify("1234", old)
+	if err != nil || !match || !needsRehash {
+		t.Fatalf("got match %t, rehash %t, error %v, want a match with rehash", match, needsRehash, err)
+	}
+	if match, _, err := hashing.verify("4321", old); match || err != nil {
+		t.Errorf("got match %t, error %v, want a wrong PIN not to match", match, err)
+	}
+	upgraded := mustHash(t, hashing, "1234")
+	if !strings.Contains(upgraded, ",k="+hashing.pepperID+"$") {
+		t.Fatalf("expected the current pepper id in %q", upgraded)
+	}
+	if match, needsRehash, err := hashing.verify("1234", upgraded); err != nil || !match || needsRehash {
+		t.Errorf("got match %t, rehash %t, error %v after the upgrade, want a match without rehash", match, needsRehash, err)
+	}
+}
+
+func TestReadPepper(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pepper")
+	if err := os.WriteFile(path, []byte(" secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pepper, err := readPepper(path)
+	if err != nil || string(pepper) != "secret" {
+		t.Errorf("got pepper %q, error %v, want the trimmed file content", pepper, err)
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{empty, filepath.Join(dir, "missing")} {
+		if _, err := readPepper(path); err == nil {
+			t.Errorf("readPepper(%q): expected an error", path)
+		}
+	}
+}
+
+func TestBcryptHashUpgrade(t *testing.T) {
+	hashing := newTestHashing("pepper")
+	legacy, err := bcrypt.GenerateFromPassword([]byte("1234"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match, needsRehash, _ := hashing.verify("1234", string(legacy))
+	if !match || !needsRehash {
+		t.Fatalf("got match %t, rehash %t, want a match with rehash", match, needsRehash)
+	}
+	if match, _, _ := hashing.verify("4321", string(legacy)); match {
+		t.Error("expected a wrong PIN not to match")
+	}
+
+	// The replacement hash verifies without further rehash
+	upgraded := mustHash(t, hashing, "1234")
+	if match, needsRehash, _ := hashing.verify("1234", upgraded); !match || needsRehash {
+		t.Errorf("got match %t, rehash %t after the upgrade, want a match without rehash", match, needsRehash)
+	}
+}
+
+func TestRehashOnWeakerParameters(t *testing.T) {
+	weak := newTestHashing("")
+	hash := mustHash(t, weak, "1234")
+
+	tests := []struct {
+		name        string
+		policy      func(h *PasswordHashing)
+		needsRehash bool
+	}{
+		{"same parameters", func(h *PasswordHashing) {}, false},
+		{"more time", func(h *PasswordHashing) { h.Time = 2 }, true},
+		{"more memory", func(h *PasswordHashing) { h.Memory = 16 * 1024 }, true},
+		{"bcrypt policy", func(h *PasswordHashing) { h.Algorithm = HashBcrypt }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hashing := newTestHashing("")
+			tt.policy(hashing)
+			match, needsRehash, _ := hashing.verify("1234", hash)
+			if !match || needsRehash != tt.needsRehash {
+				t.Errorf("got match %t, rehash %t, want a match with rehash %t", match, needsRehash, tt.needsRehash)
+			}
+		})
+	}
+
+	// A bcrypt hash below the policy cost is upgraded too
+	bcryptPolicy := newTestHashing("")
+	bcryptPolicy.Algorithm = HashBcrypt
+	cheap := mustHash(t, bcryptPolicy, "1234")
+	bcryptPolicy.BcryptCost = bcrypt.MinCost + 1
+	if match, needsRehash, _ := bcryptPolicy.verify("1234", cheap); !match || !needsRehash {
+		t.Errorf("got match %t, rehash %t, want a match with rehash", match, needsRehash)
+	}
+}
+
+func TestParseArgon2Hash(t *testing.T) {
+	valid := mustHash(t, newTestHashing("pepper"), "1234")
+	hash, err := parseArgon2Hash(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash.memory != 8*1024 || hash.time != 1 || hash.threads != 1 || hash.pepperID == "" ||
+		len(hash.salt) != argon2SaltLength || len(hash.key) != argon2KeyLength {
+		t.Errorf("unexpected parameters %+v", hash)
+	}
+
+	invalid := []string{
+		"",
+		"$2a$10$abcdefghijklmnopqrstuv",
+		"$argon2i$v=19$m=8192,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=16$m=8192,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=8192,t=1,p=1$!!$a2V5",
+		"$argon2id$v=19$m=8192,t=1,p=1$c2FsdA$",
+		"$argon2id$v=19$m=8192,t=1,p=1$c2FsdA",
+	}
+	for _, encoded := range invalid {
+		if _, err := parseArgon2Hash(encoded); err == nil {
+			t.Errorf("parseArgon2Hash(%q): expected an error", encoded)
+		}
+		if match, _, _ := newTestHashing("").verify("1234", encoded); match {
+			t.Errorf("verify(%q): expected no match", encoded)
+		}
+	}
+}
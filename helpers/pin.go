@@ -0,0 +1,186 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/emmadal/feeti-module/subject"
+)
+
+var (
+	ErrAccountLocked      = errors.New("account locked")
+	ErrMaxAttemptsReached = errors.New("maximum attempts reached")
+	ErrInvalidPin         = errors.New("invalid pin")
+	ErrPinThrottled       = errors.New("too many attempts")
+)
+
+// LockedError is returned while an account is locked. Until is nil for a permanent lock.
+type LockedError struct {
+	Until *time.Time
+}
+
+func (e *LockedError) Error() string {
+	if e.Until == nil {
+		return "account locked"
+	}
+	return fmt.Sprintf("account locked until %s", e.Until.Format(time.RFC3339))
+}
+
+func (e *LockedError) Is(target error) bool {
+	return target == ErrAccountLocked
+}
+
+// ThrottledError is returned when an attempt comes before the delay imposed by the previous failures
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+func (e *ThrottledError) Is(target error) bool {
+	return target == ErrPinThrottled
+}
+
+// CheckUserPin verifies the PIN of a user under the lockout policy shared by Login and PIN verification.
+// Failures are delayed progressively, then lock the account and its wallet, temporarily at first.
+// ipAddress and source are recorded in the failure history. ErrHashingBusy is returned when the PIN cannot be checked
+// before the deadline of ctx or of the hashing queue.
+// The duress PIN passes like the PIN itself, and duress tells the caller which one was given.
+func CheckUserPin(ctx context.Context, user *models.User, pin, ipAddress, source string) (duress bool, err error) {
+	policy := Lockout()
+
+	// Lift an expired temporary lock first
+	if user.Locked && !user.IsLocked() {
+		if err := UnlockExpiredUser(user); err != nil {
+			return false, fmt.Errorf("unable to unlock user: %w", err)
+		}
+	}
+	if user.IsLocked() {
+		return false, &LockedError{Until: user.LockedUntil}
+	}
+
+	// Wait for the delay imposed by the previous failure. Recording the attempt checks it again under the row lock.
+	rule := models.LockRule{
+		MaxAttempts: policy.MaxAttempts,
+		LockUntil:   policy.LockUntil,
+		Delay:       policy.Delay,
+	}
+	if user.LastFailedAt != nil {
+		if wait := time.Until(user.LastFailedAt.Add(policy.Delay(user.Quota))); wait > 0 {
+			return false, &ThrottledError{RetryAfter: wait}
+		}
+	}
+
+	match, needsRehash, err := VerifyPassword(ctx, pin, user.Pin)
+	if err != nil {
+		return false, fmt.Errorf("unable to verify pin: %w", err)
+	}
+	// The duress PIN is checked even when the PIN matched, so that both take as long
+	duressRehash := false
+	if user.DuressPin != nil {
+		duressMatch, rehash, err := VerifyPassword(ctx, pin, *user.DuressPin)
+		if err != nil {
+			return false, fmt.Errorf("unable to verify pin: %w", err)
+		}
+		if duressMatch && !match {
+			match, needsRehash, duress, duressRehash = true, false, true, rehash
+		}
+	}
+	if !match {
+		// Count the failure and lock the account once the attempts are exhausted, atomically
+		walletLock := NewCommandMessage(subject.SubjectWalletLock, user.ID.String())
+		rule.Outbox = func(user *models.User) ([]models.OutboxMessage, error) {
+			event, err := lockedEventMessage(user)
+			return []models.OutboxMessage{walletLock, event}, err
+		}
+		locked, err := user.RecordFailedAttempt(ipAddress, source, rule)
+		if errors.Is(err, models.ErrAttemptThrottled) {
+			return false, throttledError(user, policy)
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to record login failure: %w", err)
+		}
+		switch {
+		case locked:
+			// Lock the wallet right away when possible, otherwise the outbox relay does
+			if _, err := DeliverCommand(walletLock); err != nil {
+				log.Printf("Wallet lock for user %s deferred to the outbox relay: %v\n", user.ID, err)
+			}
+			return false, fmt.Errorf("%w: %w", ErrMaxAttemptsReached, &LockedError{Until: user.LockedUntil})
+		case user.IsLocked():
+			// A concurrent attempt locked the account first
+			return false, &LockedError{Until: user.LockedUntil}
+		default:
+			return false, ErrInvalidPin
+		}
+	}
+
+	// Clear the failures once the PIN is right, unless a concurrent attempt locked the account
+	cleared, err := user.RecordSuccessfulAttempt(rule)
+	if errors.Is(err, models.ErrAttemptThrottled) {
+		return false, throttledError(user, policy)
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to reset quota: %w", err)
+	}
+	if !cleared {
+		return false, &LockedError{Until: user.LockedUntil}
+	}
+
+	// Bring an old or weak hash up to the current policy while the PIN is at hand
+	if needsRehash {
+		go rehashUserPin(*user, pin)
+	}
+	if duressRehash {
+		go rehashDuressPin(*user, pin)
+	}
+	return duress, nil
+}
+
+// throttledError returns the delay left after the last failure of a user refreshed by a throttled attempt
+func throttledError(user *models.User, policy LockoutPolicy) *ThrottledError {
+	wait := time.Second
+	if user.LastFailedAt != nil {
+		wait = max(time.Until(user.LastFailedAt.Add(policy.Delay(user.Quota))), wait)
+	}
+	return &ThrottledError{RetryAfter: wait}
+}
+
+// rehashUserPin hashes the PIN with the current policy and stores it in place of the old hash
+func rehashUserPin(user models.User, pin string) {
+	hash, err := HashPassword(context.Background(), pin)
+	if err == nil {
+		err = user.UpgradePinHash(user.Pin, hash)
+	}
+	if err != nil {
+		log.Printf("Error upgrading the PIN hash of user %s: %v\n", user.ID, err)
+	}
+}
+
+// rehashDuressPin hashes the duress PIN with the current policy and stores it in place of the old hash
+func rehashDuressPin(user models.User, pin string) {
+	hash, err := HashPassword(context.Background(), pin)
+	if err == nil {
+		err = user.UpgradeDuressPinHash(*user.DuressPin, hash)
+	}
+	if err != nil {
+		log.Printf("Error upgrading the duress PIN hash of user %s: %v\n", user.ID, err)
+	}
+}
+
+// lockedEventMessage builds the locked event written with the lock
+func lockedEventMessage(user *models.User) (models.OutboxMessage, error) {
+	return NewEventMessage(UserLocked{
+		UserID:      user.ID,
+		Attempts:    user.Quota,
+		Reason:      "max_attempts",
+		LockedUntil: user.LockedUntil,
+		Permanent:   user.LockedUntil == nil,
+	})
+}
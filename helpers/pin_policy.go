@@ -0,0 +1,281 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+)
+
+const (
+	defaultPinHistorySize = 5
+	maxPinLength          = 12
+)
+
+// LegacyPinLength is the length of the PINs chosen before the PIN length became configurable
+const LegacyPinLength = 4
+
+// PIN policy rejection reasons
+const (
+	PinReasonLength   = "pin_length"
+	PinReasonSequence = "pin_sequence"
+	PinReasonRepeated = "pin_repeated"
+	PinReasonDenied   = "pin_denied"
+	PinReasonYear     = "pin_year"
+	PinReasonReused   = "pin_reused"
+	PinReasonDuress   = "pin_duress"
+)
+
+// ErrWeakPin is matched by the errors of a PIN rejected by the policy
+var ErrWeakPin = errors.New("pin rejected by policy")
+
+// defaultPinDenyList holds the most used PINs, on top of the sequences and repeats rejected anyway
+var defaultPinDenyList = []string{
+	"1004", "1010", "1122", "1313", "2001", "2580", "6969", "0852", "1478", "3690",
+	"112233", "121212", "123123", "147258", "159753", "258369", "789456", "696969",
+}
+
+// pinMessages are the localized messages of the rejection reasons, by language
+var pinMessages = map[string]map[string]string{
+	"en": {
+		"rejected":        "This PIN is not allowed. Please choose another one",
+		PinReasonLength:   "The PIN must have %d digits",
+		PinReasonSequence: "The PIN must not be a sequence of digits such as 1234",
+		PinReasonRepeated: "The PIN must not repeat the same digits such as 1111 or 1212",
+		PinReasonDenied:   "This PIN is too common",
+		PinReasonYear:     "The PIN must not be a year, such as a birth year",
+		PinReasonReused:   "The PIN must be different from your previous PINs",
+		PinReasonDuress:   "The PIN and the duress PIN must be different",
+	},
+	"fr": {
+		"rejected":        "Ce code PIN n'est pas autorisé. Veuillez en choisir un autre",
+		PinReasonLength:   "Le code PIN doit comporter %d chiffres",
+		PinReasonSequence: "Le code PIN ne doit pas être une suite de chiffres comme 1234",
+		PinReasonRepeated: "Le code PIN ne doit pas répéter les mêmes chiffres comme 1111 ou 1212",
+		PinReasonDenied:   "Ce code PIN est trop courant",
+		PinReasonYear:     "Le code PIN ne doit pas être une année, comme une année de naissance",
+		PinReasonReused:   "Le code PIN doit être différent de vos codes précédents",
+		PinReasonDuress:   "Le code PIN et le code PIN de contrainte doivent être différents",
+	},
+}
+
+// PinReason is a localized rejection reason
+type PinReason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PinPolicyError lists the reasons why a PIN was rejected. Length is the required length.
+type PinPolicyError struct {
+	Reasons []string
+	Length  int
+}
+
+func (e *PinPolicyError) Error() string {
+	return "pin rejected by policy: " + strings.Join(e.Reasons, ", ")
+}
+
+func (e *PinPolicyError) Is(target error) bool {
+	return target == ErrWeakPin
+}
+
+// Message returns the summary of the rejection in the language
+func (e *PinPolicyError) Message(language string) string {
+	return pinMessages[language]["rejected"]
+}
+
+// Localize returns the reasons with their messages in the language
+func (e *PinPolicyError) Localize(language string) []PinReason {
+	reasons := make([]PinReason, 0, len(e.Reasons))
+	for _, code := range e.Reasons {
+		message := pinMessages[language][code]
+		if code == PinReasonLength {
+			message = fmt.Sprintf(message, e.Length)
+		}
+		reasons = append(reasons, PinReason{Code: code, Message: message})
+	}
+	return reasons
+}
+
+// PinLanguage picks the language of PIN policy messages from an Accept-Language header, English by default
+func PinLanguage(acceptLanguage string) string {
+	for _, tag := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ = strings.Cut(strings.TrimSpace(tag), ";")
+		language, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := pinMessages[language]; ok {
+			return language
+		}
+	}
+	return "en"
+}
+
+// PinPolicy sets the length of PINs and rejects guessable PINs and the reuse of previous ones.
+// In migration mode, users whose PIN does not have the current length are asked to change it at login.
+type PinPolicy struct {
+	Length      int
+	Migration   bool
+	DenyList    map[string]bool
+	RejectYears bool
+	HistorySize int // number of PINs, the current one included, that cannot be reused
+}
+
+var (
+	pinPolicy     *PinPolicy
+	pinPolicyOnce sync.Once
+)
+
+// GetPinPolicy returns the policy configured from PIN_LENGTH, PIN_MIGRATION, PIN_DENY_LIST, PIN_REJECT_YEARS
+// and PIN_HISTORY_SIZE
+func GetPinPolicy() *PinPolicy {
+	pinPolicyOnce.Do(func() {
+		pinPolicy = &PinPolicy{
+			Length:      LegacyPinLength,
+			Migration:   os.Getenv("PIN_MIGRATION") == "true",
+			DenyList:    make(map[string]bool),
+			RejectYears: os.Getenv("PIN_REJECT_YEARS") != "false",
+			HistorySize: defaultPinHistorySize,
+		}
+		for _, pin := range defaultPinDenyList {
+			pinPolicy.DenyList[pin] = true
+		}
+		for _, pin := range strings.Split(os.Getenv("PIN_DENY_LIST"), ",") {
+			if pin = strings.TrimSpace(pin); pin != "" {
+				pinPolicy.DenyList[pin] = true
+			}
+		}
+		if length, err := strconv.Atoi(os.Getenv("PIN_LENGTH")); err == nil && length >= LegacyPinLength && length <= maxPinLength {
+			pinPolicy.Length = length
+		}
+		if size, err := strconv.Atoi(os.Getenv("PIN_HISTORY_SIZE")); err == nil && size >= 0 {
+			pinPolicy.HistorySize = min(size, models.MaxPinHistory+1)
+		}
+	})
+	return pinPolicy
+}
+
+// Check rejects a new PIN that does not have the policy length, is a sequence, repeats digits, is denied or is a year
+func (p *PinPolicy) Check(pin string) error {
+	pin = strings.TrimSpace(pin)
+	if len(pin) != p.Length || !isDigits(pin) {
+		return &PinPolicyError{Reasons: []string{PinReasonLength}, Length: p.Length}
+	}
+
+	var reasons []string
+	if isPinSequence(pin) {
+		reasons = append(reasons, PinReasonSequence)
+	}
+	if isPinRepeated(pin) {
+		reasons = append(reasons, PinReasonRepeated)
+	}
+	if p.DenyList[pin] {
+		reasons = append(reasons, PinReasonDenied)
+	}
+	if p.RejectYears && isPinYear(pin) {
+		reasons = append(reasons, PinReasonYear)
+	}
+	if len(reasons) > 0 {
+		return &PinPolicyError{Reasons: reasons, Length: p.Length}
+	}
+	return nil
+}
+
+// CheckReuse rejects a PIN that matches the duress PIN, the current PIN of the user or one of its previous ones.
+// Hashes made with a pepper that is no longer known are skipped, so that the PIN can still be reset.
+func (p *PinPolicy) CheckReuse(ctx context.Context, user *models.User, pin string) error {
+	pin = strings.TrimSpace(pin)
+	if user.DuressPin != nil {
+		match, _, err := VerifyPassword(ctx, pin, *user.DuressPin)
+		if err != nil && !errors.Is(err, ErrUnknownPepper) {
+			return err
+		}
+		if match {
+			return &PinPolicyError{Reasons: []string{PinReasonDuress}, Length: p.Length}
+		}
+	}
+	if p.HistorySize == 0 {
+		return nil
+	}
+
+	hashes := []string{user.Pin}
+	if p.HistorySize > 1 {
+		previous, err := models.GetPinHistory(user.ID, p.HistorySize-1)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, previous...)
+	}
+
+	for _, hash := range hashes {
+		match, _, err := VerifyPassword(ctx, pin, hash)
+		if err != nil && !errors.Is(err, ErrUnknownPepper) {
+			return err
+		}
+		if match {
+			return &PinPolicyError{Reasons: []string{PinReasonReused}, Length: p.Length}
+		}
+	}
+	return nil
+}
+
+// ValidPin reports whether an existing PIN has a valid format: digits, with the policy length or the legacy one
+func (p *PinPolicy) ValidPin(pin string) bool {
+	pin = strings.TrimSpace(pin)
+	return (len(pin) == p.Length || len(pin) == LegacyPinLength) && isDigits(pin)
+}
+
+// NeedsUpgrade reports whether the user must choose a PIN of the policy length
+func (p *PinPolicy) NeedsUpgrade(user *models.User) bool {
+	return p.Migration && user.PinLength != p.Length
+}
+
+// isDigits reports whether s only holds ASCII digits
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isPinSequence reports whether each digit follows the previous one up or down, such as 1234, 9876 or 8901
+func isPinSequence(pin string) bool {
+	if len(pin) < 3 {
+		return false
+	}
+	step := (int(pin[1]) - int(pin[0]) + 10) % 10
+	if step != 1 && step != 9 {
+		return false
+	}
+	for i := 2; i < len(pin); i++ {
+		if (int(pin[i])-int(pin[i-1])+10)%10 != step {
+			return false
+		}
+	}
+	return true
+}
+
+// isPinRepeated reports whether the PIN is a shorter pattern repeated, such as 1111, 1212 or 123123
+func isPinRepeated(pin string) bool {
+	for period := 1; period <= len(pin)/2; period++ {
+		if len(pin)%period == 0 && strings.Repeat(pin[:period], len(pin)/period) == pin {
+			return true
+		}
+	}
+	return false
+}
+
+// isPinYear reports whether a 4-digit PIN is a year from 1900 to next year
+func isPinYear(pin string) bool {
+	if len(pin) != 4 {
+		return false
+	}
+	year, err := strconv.Atoi(pin)
+	return err == nil && year >= 1900 && year <= time.Now().Year()+1
+}
@@ -0,0 +1,278 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/google/uuid"
+)
+
+// connectTestDatabase connects to the Postgres database in TEST_DATABASE_URL, which the test workflow provides.
+// Locally, the test is skipped without one.
+func connectTestDatabase(t *testing.T) {
+	t.Helper()
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatal("TEST_DATABASE_URL must be set in CI")
+		}
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	t.Setenv("DATABASE_URL", databaseURL)
+	t.Setenv("JWT_KEY", "test")
+	models.DBConnect()
+}
+
+// createTestUser creates a user with a random phone number, removed when the test ends
+func createTestUser(t *testing.T, pinHash string) *models.User {
+	t.Helper()
+	newUser := models.User{
+		FirstName:   "Test",
+		LastName:    "User",
+		PhoneNumber: fmt.Sprintf("+225%010d", time.Now().UnixNano()%10000000000),
+		DeviceToken: "test",
+		Pin:         pinHash,
+		PinLength:   4,
+	}
+	user, err := newUser.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = user.RollbackUser()
+	})
+	return user
+}
+
+// reloadLockout makes Lockout read the environment again, and again once the test has restored it
+func reloadLockout(t *testing.T) {
+	t.Helper()
+	lockoutPolicyOnce = sync.Once{}
+	t.Cleanup(func() {
+		lockoutPolicyOnce = sync.Once{}
+	})
+}
+
+// TestCheckUserPinConcurrentFailures fires parallel bad logins at one account and checks that
+// exactly MaxAttempts failures are counted and a single attempt locks the account.
+// It needs a Postgres database.
+func TestCheckUserPinConcurrentFailures(t *testing.T) {
+	connectTestDatabase(t)
+	t.Setenv("LOCKOUT_DELAYS", "0s")
+	reloadLockout(t)
+
+	const parallel = 10
+	policy := Lockout()
+
+	hashedPin, err := HashPassword(context.Background(), "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := createTestUser(t, hashedPin)
+
+	// Load the user in every request before any attempt is recorded, as Login does
+	users := make([]*models.User, parallel)
+	for i := range users {
+		lookup := &models.User{PhoneNumber: user.PhoneNumber}
+		if users[i], err = lookup.GetUserByPhone(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results := make([]error, parallel)
+	var start, done sync.WaitGroup
+	start.Add(1)
+	for i := range users {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			start.Wait()
+			_, results[i] = CheckUserPin(context.Background(), users[i], "0000", "127.0.0.1", "test")
+		}()
+	}
+	start.Done()
+	done.Wait()
+
+	var invalid, lockedNow, alreadyLocked int
+	for _, err := range results {
+		switch {
+		case errors.Is(err, ErrMaxAttemptsReached):
+			lockedNow++
+		case errors.Is(err, ErrAccountLocked):
+			alreadyLocked++
+		case errors.Is(err, ErrInvalidPin):
+			invalid++
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if lockedNow != 1 {
+		t.Errorf("expected exactly one attempt to lock the account, got %d", lockedNow)
+	}
+	if invalid != policy.MaxAttempts-1 {
+		t.Errorf("expected %d invalid attempts, got %d", policy.MaxAttempts-1, invalid)
+	}
+	if alreadyLocked != parallel-policy.MaxAttempts {
+		t.Errorf("expected %d attempts rejected as locked, got %d", parallel-policy.MaxAttempts, alreadyLocked)
+	}
+
+	current, err := models.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(current.Quota) != policy.MaxAttempts || !current.Locked || current.LockCount != 1 {
+		t.Errorf("unexpected account state: quota %d, locked %t, lock count %d",
+			current.Quota, current.Locked, current.LockCount)
+	}
+
+	var failures int
+	err = models.DB.QueryRow(
+		context.Background(), `SELECT COUNT(*) FROM login_failures WHERE user_id = $1`, user.ID,
+	).Scan(&failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != policy.MaxAttempts {
+		t.Errorf("expected %d recorded failures, got %d", policy.MaxAttempts, failures)
+	}
+}
+
+// TestCheckUserPinConcurrentDelay fires parallel bad logins at one account loaded before any failure
+// and checks that only the first is verified while the others wait for the delay, and that the right PIN
+// waits for it too. It needs a Postgres database.
+func TestCheckUserPinConcurrentDelay(t *testing.T) {
+	connectTestDatabase(t)
+	t.Setenv("LOCKOUT_DELAYS", "1m")
+	reloadLockout(t)
+
+	const parallel = 10
+
+	hashedPin, err := HashPassword(context.Background(), "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := createTestUser(t, hashedPin)
+
+	// Load the user in every request before any attempt is recorded, as Login does
+	users := make([]*models.User, parallel+1)
+	for i := range users {
+		lookup := &models.User{PhoneNumber: user.PhoneNumber}
+		if users[i], err = lookup.GetUserByPhone(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results := make([]error, parallel)
+	var start, done sync.WaitGroup
+	start.Add(1)
+	for i := range parallel {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			start.Wait()
+			_, results[i] = CheckUserPin(context.Background(), users[i], "0000", "127.0.0.1", "test")
+		}()
+	}
+	start.Done()
+	done.Wait()
+
+	var invalid, throttled int
+	for _, err := range results {
+		switch {
+		case errors.Is(err, ErrInvalidPin):
+			invalid++
+		case errors.Is(err, ErrPinThrottled):
+			throttled++
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if invalid != 1 || throttled != parallel-1 {
+		t.Errorf("expected 1 invalid and %d throttled attempts, got %d and %d", parallel-1, invalid, throttled)
+	}
+
+	// The right PIN, checked against the same earlier read, waits for the delay as well
+	if _, err := CheckUserPin(context.Background(), users[parallel], "1234", "127.0.0.1", "test"); !errors.Is(err, ErrPinThrottled) {
+		t.Errorf("expected the right PIN to be throttled, got %v", err)
+	}
+
+	current, err := models.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Quota != 1 || current.Locked {
+		t.Errorf("unexpected account state: quota %d, locked %t", current.Quota, current.Locked)
+	}
+}
+
+// TestPepperedHashFitsSchema stores a peppered hash made with the default parameters in every PIN column.
+// It needs a Postgres database.
+func TestPepperedHashFitsSchema(t *testing.T) {
+	connectTestDatabase(t)
+
+	hashing := newTestHashing("pepper")
+	hashing.Memory, hashing.Time, hashing.Threads = defaultArgon2Memory, defaultArgon2Time, defaultArgon2Threads
+	hashes := make([]string, 3)
+	for i := range hashes {
+		hashes[i] = mustHash(t, hashing, fmt.Sprintf("%d", 1357+i))
+	}
+	if len(hashes[0]) <= 100 {
+		t.Fatalf("expected a peppered hash longer than 100 characters, got %d", len(hashes[0]))
+	}
+
+	user := createTestUser(t, hashes[0])
+	user.DuressPin = &hashes[1]
+	if err := user.UpdateDuressPin(); err != nil {
+		t.Fatalf("storing the duress PIN: %v", err)
+	}
+	// The current hash moves to the PIN history
+	user.Pin, user.PinLength = hashes[2], 4
+	if err := user.UpdateUserPin(); err != nil {
+		t.Fatalf("updating the PIN: %v", err)
+	}
+
+	pending := models.PendingRegistration{
+		KeyUID:      uuid.New(),
+		FirstName:   "Test",
+		LastName:    "User",
+		PhoneNumber: user.PhoneNumber,
+		DeviceToken: "test",
+		Pin:         hashes[0],
+		PinLength:   4,
+		ExpiresAt:   time.Now().Add(time.Minute),
+	}
+	if err := pending.CreatePendingRegistration(); err != nil {
+		t.Fatalf("storing the pending registration: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = pending.DeletePendingRegistration()
+	})
+
+	current, err := models.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Pin != hashes[2] || current.DuressPin == nil || *current.DuressPin != hashes[1] {
+		t.Error("expected the PIN and duress PIN hashes to be stored whole")
+	}
+	history, err := models.GetPinHistory(user.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0] != hashes[0] {
+		t.Errorf("expected the previous hash in the PIN history, got %v", history)
+	}
+	stored, err := models.GetPendingRegistration(pending.KeyUID, pending.PhoneNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Pin != hashes[0] {
+		t.Error("expected the pending registration hash to be stored whole")
+	}
+}
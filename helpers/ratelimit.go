@@ -0,0 +1,283 @@
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emmadal/feeti-auth/ratelimit"
+	status "github.com/emmadal/feeti-module/status"
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	RateLimitBucket     = "AUTH_RATE_LIMITS"
+	rateLimitBodyLimit  = 1 << 20
+	rateLimitKVTTL      = 24 * time.Hour
+	rateLimitKVDeadline = 500 * time.Millisecond
+)
+
+// RateLimitPolicy holds the limits of a route by client IP, device token and phone number
+type RateLimitPolicy struct {
+	IP     ratelimit.Limit
+	Device ratelimit.Limit
+	Phone  ratelimit.Limit
+}
+
+// defaultRateLimits are the route limits used when RATE_LIMIT_<ROUTE> is not set
+var defaultRateLimits = map[string]RateLimitPolicy{
+	"login": {
+		IP:     ratelimit.Limit{Burst: 30, Period: time.Minute},
+		Device: ratelimit.Limit{Burst: 10, Period: time.Minute},
+		Phone:  ratelimit.Limit{Burst: 5, Period: time.Minute},
+	},
+	"register": {
+		IP:     ratelimit.Limit{Burst: 10, Period: time.Hour},
+		Device: ratelimit.Limit{Burst: 5, Period: time.Hour},
+		Phone:  ratelimit.Limit{Burst: 5, Period: time.Hour},
+	},
+	"register-confirm": {
+		IP:     ratelimit.Limit{Burst: 10, Period: time.Minute},
+		Device: ratelimit.Limit{Burst: 5, Period: time.Minute},
+		Phone:  ratelimit.Limit{Burst: 5, Period: time.Minute},
+	},
+	"token-refresh": {
+		// Refresh requests carry neither a phone number nor a device token
+		IP: ratelimit.Limit{Burst: 30, Period: time.Minute},
+	},
+	"update-pin": {
+		IP:     ratelimit.Limit{Burst: 10, Period: time.Minute},
+		Device: ratelimit.Limit{Burst: 5, Period: time.Minute},
+		Phone:  ratelimit.Limit{Burst: 5, Period: time.Minute},
+	},
+	"remove-account": {
+		IP:     ratelimit.Limit{Burst: 10, Period: time.Minute},
+		Device: ratelimit.Limit{Burst: 5, Period: time.Minute},
+		Phone:  ratelimit.Limit{Burst: 5, Period: time.Minute},
+	},
+	"forgot-pin": {
+		IP:     ratelimit.Limit{Burst: 10, Period: time.Hour},
+		Device: ratelimit.Limit{Burst: 5, Period: time.Hour},
+		Phone:  ratelimit.Limit{Burst: 5, Period: time.Hour},
+	},
+	"reset-pin": {
+		IP:     ratelimit.Limit{Burst: 10, Period: time.Minute},
+		Device: ratelimit.Limit{Burst: 5, Period: time.Minute},
+		Phone:  ratelimit.Limit{Burst: 5, Period: time.Minute},
+	},
+	"unlock-request": {
+		IP:     ratelimit.Limit{Burst: 10, Period: time.Hour},
+		Device: ratelimit.Limit{Burst: 5, Period: time.Hour},
+		Phone:  ratelimit.Limit{Burst: 5, Period: time.Hour},
+	},
+	"unlock-confirm": {
+		IP:     ratelimit.Limit{Burst: 10, Period: time.Minute},
+		Device: ratelimit.Limit{Burst: 5, Period: time.Minute},
+		Phone:  ratelimit.Limit{Burst: 5, Period: time.Minute},
+	},
+	"duress-pin": {
+		IP:     ratelimit.Limit{Burst: 10, Period: time.Minute},
+		Device: ratelimit.Limit{Burst: 5, Period: time.Minute},
+		Phone:  ratelimit.Limit{Burst: 5, Period: time.Minute},
+	},
+}
+
+var (
+	rateLimitMu     sync.RWMutex
+	rateLimitStore  ratelimit.Store
+	rateLimitMemory = ratelimit.NewMemoryStore()
+)
+
+// rateLimitKeys are the request fields that limits are keyed by
+type rateLimitKeys struct {
+	PhoneNumber string `json:"phone_number"`
+	DeviceToken string `json:"device_token"`
+}
+
+// setupRateLimitStore creates the KV bucket shared by replicas when RATE_LIMIT_BACKEND is "nats".
+// Until it is ready, or when the bucket cannot be reached, limits are kept in memory.
+func setupRateLimitStore(config NatsConfig) error {
+	if os.Getenv("RATE_LIMIT_BACKEND") != "nats" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("unable to create JetStream context: %w", err)
+	}
+	kv, err := stream.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      RateLimitBucket,
+		Description: "Feeti auth rate limit buckets",
+		History:     1,
+		TTL:         rateLimitKVTTL,
+		Storage:     jetstream.MemoryStorage,
+		Replicas:    config.Replicas,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create key-value bucket %s: %w", RateLimitBucket, err)
+	}
+
+	rateLimitMu.Lock()
+	rateLimitStore = ratelimit.NewKVStore(kv)
+	rateLimitMu.Unlock()
+	return nil
+}
+
+// takeRateLimit takes a token from the shared store, or from memory when the shared store fails
+func takeRateLimit(ctx context.Context, key string, limit ratelimit.Limit) ratelimit.Result {
+	rateLimitMu.RLock()
+	store := rateLimitStore
+	rateLimitMu.RUnlock()
+
+	if store != nil {
+		ctx, cancel := context.WithTimeout(ctx, rateLimitKVDeadline)
+		defer cancel()
+		result, err := store.Take(ctx, key, limit)
+		if err == nil {
+			return result
+		}
+		log.Printf("Error taking rate limit token, using the local limit: %v\n", err)
+	}
+	result, _ := rateLimitMemory.Take(ctx, key, limit)
+	return result
+}
+
+// TakeAttempt takes a token from the bucket of key, kept like the route limits. Unlike a count of logged
+// attempts, it is decided before the attempt is checked, so parallel requests cannot go past the limit.
+func TakeAttempt(ctx context.Context, key string, limit ratelimit.Limit) ratelimit.Result {
+	return takeRateLimit(ctx, key, limit)
+}
+
+// rateLimitPolicy returns the limits of a route, from RATE_LIMIT_<ROUTE> such as "ip=30/1m,device=10/1m,phone=5/1m".
+// Keys missing from the variable keep their default, and "0" disables a limit.
+func rateLimitPolicy(route string) RateLimitPolicy {
+	policy := defaultRateLimits[route]
+	name := "RATE_LIMIT_" + strings.ToUpper(strings.ReplaceAll(route, "-", "_"))
+	value := os.Getenv(name)
+	if value == "" {
+		return policy
+	}
+	for _, part := range strings.Split(value, ",") {
+		key, raw, _ := strings.Cut(strings.TrimSpace(part), "=")
+		limit, err := ratelimit.ParseLimit(raw)
+		if err != nil {
+			log.Printf("Ignoring %s entry %q: %v\n", name, part, err)
+			continue
+		}
+		switch key {
+		case "ip":
+			policy.IP = limit
+		case "device":
+			policy.Device = limit
+		case "phone":
+			policy.Phone = limit
+		default:
+			log.Printf("Ignoring %s entry %q: unknown key\n", name, part)
+		}
+	}
+	return policy
+}
+
+// peekRateLimitKeys reads the phone number and device token from the JSON body and restores the body for the handler
+func peekRateLimitKeys(c *gin.Context) rateLimitKeys {
+	var keys rateLimitKeys
+	if c.Request.Body == nil {
+		return keys
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, rateLimitBodyLimit))
+	_ = c.Request.Body.Close()
+	c.Request.Body = io.NopCloser(bytes.NewReader(data))
+	if err == nil {
+		_ = json.Unmarshal(data, &keys)
+	}
+	return keys
+}
+
+// TrustedProxies returns the proxies, as IPs or CIDRs separated by commas in TRUSTED_PROXIES, whose
+// X-Forwarded-For and X-Real-IP headers give the client IP. Without any, the client IP is the peer address.
+func TrustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// RateLimit limits the requests to a route with token buckets keyed by client IP, device token and phone number.
+// Keys that are missing from the request are not limited. Every response carries the RateLimit-* headers
+// of the most restrictive bucket; a rejected request gets a 429 with Retry-After.
+func RateLimit(route string) gin.HandlerFunc {
+	policy := rateLimitPolicy(route)
+
+	return func(c *gin.Context) {
+		keys := peekRateLimitKeys(c)
+		checks := []struct {
+			name  string
+			value string
+			limit ratelimit.Limit
+		}{
+			{"ip", c.ClientIP(), policy.IP},
+			{"device", strings.TrimSpace(keys.DeviceToken), policy.Device},
+			{"phone", strings.TrimSpace(keys.PhoneNumber), policy.Phone},
+		}
+
+		var tightest *ratelimit.Result
+		var rejected *ratelimit.Result
+		var rejectedBy string
+		for _, check := range checks {
+			if check.value == "" || !check.limit.Enabled() {
+				continue
+			}
+			result := takeRateLimit(c.Request.Context(), route+":"+check.name+":"+check.value, check.limit)
+			if !result.Allowed {
+				if rejected == nil || result.RetryAfter > rejected.RetryAfter {
+					rejected, rejectedBy = &result, check.name
+				}
+				continue
+			}
+			if tightest == nil || result.Remaining < tightest.Remaining {
+				tightest = &result
+			}
+		}
+
+		if rejected != nil {
+			setRateLimitHeaders(c, *rejected)
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(rejected.RetryAfter)))
+			RateLimitedTotal.WithLabelValues(route, rejectedBy).Inc()
+			status.HandleError(c, http.StatusTooManyRequests, "Too many requests. Please try again later", nil)
+			c.Abort()
+			return
+		}
+		if tightest != nil {
+			setRateLimitHeaders(c, *tightest)
+		}
+		c.Next()
+	}
+}
+
+// setRateLimitHeaders writes the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers
+func setRateLimitHeaders(c *gin.Context, result ratelimit.Result) {
+	c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
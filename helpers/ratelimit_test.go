@@ -0,0 +1,46 @@
+package helpers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name       string
+		proxies    string
+		remoteAddr string
+		want       string
+	}{
+		{"no proxy", "", "192.0.2.1:4000", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.0/8, 172.16.0.1", "10.1.2.3:4000", "203.0.113.7"},
+		{"trusted proxy address", "10.0.0.0/8, 172.16.0.1", "172.16.0.1:4000", "203.0.113.7"},
+		{"untrusted peer", "10.0.0.0/8", "192.0.2.1:4000", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.proxies)
+			engine := gin.New()
+			if err := engine.SetTrustedProxies(TrustedProxies()); err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			engine.GET("/", func(c *gin.Context) {
+				got = c.ClientIP()
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			engine.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("got client IP %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
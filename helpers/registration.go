@@ -0,0 +1,184 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/emmadal/feeti-auth/walletclient"
+	"github.com/emmadal/feeti-module/subject"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultRegistrationTimeout     = 2 * time.Minute
+	defaultRegistrationMaxAttempts = 5
+	registrationReconcileInterval  = 30 * time.Second
+	registrationReconcileBatch     = 50
+)
+
+// registrationTimeout returns how long a saga may stay in the same step before the reconciler takes over,
+// from REGISTRATION_SAGA_TIMEOUT
+func registrationTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(os.Getenv("REGISTRATION_SAGA_TIMEOUT")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultRegistrationTimeout
+}
+
+// registrationMaxAttempts returns how many wallet requests are made before a registration is rolled back,
+// from REGISTRATION_SAGA_MAX_ATTEMPTS
+func registrationMaxAttempts() int {
+	if attempts, err := strconv.Atoi(os.Getenv("REGISTRATION_SAGA_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		return attempts
+	}
+	return defaultRegistrationMaxAttempts
+}
+
+// StartRegistration creates the user of a confirmed pending registration and starts its saga
+func StartRegistration(pending *models.PendingRegistration) (*models.RegistrationSaga, *models.User, error) {
+	user := models.User{
+		FirstName:   pending.FirstName,
+		LastName:    pending.LastName,
+		PhoneNumber: pending.PhoneNumber,
+		DeviceToken: pending.DeviceToken,
+		Pin:         pending.Pin,
+		PinLength:   pending.PinLength,
+	}
+	return models.StartRegistrationSaga(&user, pending.KeyUID)
+}
+
+// RequestWallet asks the wallet service to create the user's wallet and records the outcome in the saga
+func RequestWallet(saga *models.RegistrationSaga) (*models.Wallet, error) {
+	if err := saga.Advance(models.SagaWalletRequested, nil); err != nil {
+		return nil, err
+	}
+
+	wallet, err := WalletClient().Create(context.Background(), saga.UserID)
+	if err != nil {
+		if recordErr := saga.RecordFailure(err); recordErr != nil {
+			log.Printf("Error recording registration saga %s failure: %v\n", saga.ID, recordErr)
+		}
+		return nil, err
+	}
+
+	saga.WalletID = &wallet.ID
+	if err := saga.Advance(models.SagaWalletConfirmed, nil); err != nil {
+		return nil, err
+	}
+	return wallet, nil
+}
+
+// SessionIssued records the session created for the new user
+func SessionIssued(saga *models.RegistrationSaga, sessionID uuid.UUID) error {
+	saga.SessionID = &sessionID
+	return saga.Advance(models.SagaSessionIssued, nil)
+}
+
+// CompleteRegistration ends the saga and publishes the registered event
+func CompleteRegistration(saga *models.RegistrationSaga, user *models.User) error {
+	registered, err := NewEventMessage(UserRegistered{
+		UserID:      user.ID,
+		PhoneNumber: user.PhoneNumber,
+		FirstName:   user.FirstName,
+		LastName:    user.LastName,
+	})
+	if err != nil {
+		return err
+	}
+	return saga.Complete(registered)
+}
+
+// CompensateRegistration undoes the steps of a saga: the session is revoked, the wallet disabled
+// once it may exist, and the user deleted
+func CompensateRegistration(saga *models.RegistrationSaga, cause error) error {
+	walletRequested := saga.State != models.SagaUserCreated
+	if err := saga.Advance(models.SagaCompensating, cause); err != nil {
+		return err
+	}
+
+	// A timed out wallet request may still have created the wallet
+	var outbox []models.OutboxMessage
+	if walletRequested || saga.WalletID != nil {
+		outbox = append(outbox, NewCommandMessage(subject.SubjectWalletDisable, saga.UserID.String()))
+	}
+
+	// Deleting the user deletes its sessions
+	if err := saga.RollBack(outbox...); err != nil {
+		return err
+	}
+	if saga.SessionID != nil {
+		ForgetSessions(*saga.SessionID)
+	}
+	log.Printf("Rolled back registration of user %s: %v\n", saga.UserID, cause)
+	return nil
+}
+
+// reconcileRegistration finishes or rolls back a saga that stopped halfway
+func reconcileRegistration(saga *models.RegistrationSaga) error {
+	switch saga.State {
+	case models.SagaUserCreated, models.SagaWalletRequested:
+		// The wallet service handles wallet creation idempotently, so the request is sent again
+		if saga.Attempts >= registrationMaxAttempts() {
+			return CompensateRegistration(saga, fmt.Errorf("wallet not confirmed after %d attempts", saga.Attempts))
+		}
+		if _, err := RequestWallet(saga); err != nil {
+			if errors.Is(err, walletclient.ErrRejected) {
+				return CompensateRegistration(saga, err)
+			}
+			return err
+		}
+		fallthrough
+	case models.SagaWalletConfirmed, models.SagaSessionIssued:
+		// The user can sign in without the session of the interrupted request
+		user, err := models.GetUserByID(saga.UserID)
+		if err != nil {
+			return err
+		}
+		return CompleteRegistration(saga, user)
+	case models.SagaCompensating:
+		var cause error
+		if saga.LastError != nil {
+			cause = fmt.Errorf("%s", *saga.LastError)
+		}
+		return CompensateRegistration(saga, cause)
+	default:
+		return fmt.Errorf("unexpected registration saga state %s", saga.State)
+	}
+}
+
+// ReconcileRegistrations handles the sagas that have not moved for longer than the registration timeout
+func ReconcileRegistrations() error {
+	sagas, err := models.GetStuckRegistrationSagas(time.Now().Add(-registrationTimeout()), registrationReconcileBatch)
+	if err != nil {
+		return err
+	}
+	for i := range sagas {
+		if err := reconcileRegistration(&sagas[i]); err != nil {
+			log.Printf("Error reconciling registration saga %s: %v\n", sagas[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// StartRegistrationReconciler reconciles stuck registrations in the background.
+// Replicas compete for an advisory lock, so a single one reconciles at a time.
+func StartRegistrationReconciler() {
+	go func() {
+		for range time.Tick(registrationReconcileInterval) {
+			_, err := models.WithRegistrationReconcilerLock(func() {
+				if err := ReconcileRegistrations(); err != nil {
+					log.Printf("Error reconciling registrations: %v\n", err)
+				}
+			})
+			if err != nil {
+				log.Printf("Error acquiring registration reconciler lock: %v\n", err)
+			}
+		}
+	}()
+}
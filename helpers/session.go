@@ -0,0 +1,173 @@
+package helpers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const defaultSessionCacheTTL = 30 * time.Second
+
+type cachedSession struct {
+	userID    uuid.UUID
+	active    bool
+	duress    bool
+	expiresAt time.Time
+	cachedAt  time.Time
+}
+
+// sessionCache keeps session states in memory to avoid a database round trip on every request.
+// Revocations made by another replica are picked up once the entry is older than the cache TTL.
+var sessionCache = struct {
+	sync.RWMutex
+	entries map[uuid.UUID]cachedSession
+}{entries: make(map[uuid.UUID]cachedSession)}
+
+// sessionCacheTTL returns the cache TTL from SESSION_CACHE_TTL
+func sessionCacheTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("SESSION_CACHE_TTL")); err == nil && ttl >= 0 {
+		return ttl
+	}
+	return defaultSessionCacheTTL
+}
+
+// CheckSession reports whether the session exists, belongs to the user and is neither revoked nor expired,
+// and for an active session whether it was opened with the duress PIN
+func CheckSession(sessionID, userID uuid.UUID) (active bool, duress bool, err error) {
+	now := time.Now()
+
+	sessionCache.RLock()
+	entry, ok := sessionCache.entries[sessionID]
+	sessionCache.RUnlock()
+
+	if !ok || now.Sub(entry.cachedAt) > sessionCacheTTL() {
+		session, err := models.GetSession(sessionID)
+		if err != nil {
+			if errors.Is(err, models.ErrSessionNotFound) {
+				return false, false, nil
+			}
+			return false, false, err
+		}
+		entry = cachedSession{
+			userID:    session.UserID,
+			active:    session.RevokedAt == nil,
+			duress:    session.Duress,
+			expiresAt: session.ExpiresAt,
+			cachedAt:  now,
+		}
+		sessionCache.Lock()
+		sessionCache.entries[sessionID] = entry
+		sessionCache.Unlock()
+
+		// Record activity when the cache is refreshed, at most once per TTL
+		go func() {
+			if err := models.TouchSession(sessionID); err != nil {
+				log.Printf("Error touching session: %v\n", err)
+			}
+		}()
+	}
+
+	if !entry.active || entry.userID != userID || !now.Before(entry.expiresAt) {
+		return false, false, nil
+	}
+	return true, entry.duress, nil
+}
+
+// RevokeSession revokes a session and drops it from the cache
+func RevokeSession(sessionID uuid.UUID) error {
+	if err := models.RevokeSession(sessionID); err != nil {
+		return err
+	}
+	ForgetSessions(sessionID)
+	return nil
+}
+
+// RevokeUserSessions revokes every session of a user and drops them from the cache
+func RevokeUserSessions(userID uuid.UUID) error {
+	ids, err := models.RevokeUserSessions(userID)
+	if err != nil {
+		return err
+	}
+	ForgetSessions(ids...)
+	return nil
+}
+
+// ForgetSessions removes sessions from the cache
+func ForgetSessions(ids ...uuid.UUID) {
+	sessionCache.Lock()
+	defer sessionCache.Unlock()
+	for _, id := range ids {
+		delete(sessionCache.entries, id)
+	}
+}
+
+// PurgeSessionCache removes expired entries from the session cache
+func PurgeSessionCache() {
+	ttl := sessionCacheTTL()
+	now := time.Now()
+
+	sessionCache.Lock()
+	defer sessionCache.Unlock()
+	for id, entry := range sessionCache.entries {
+		if now.Sub(entry.cachedAt) > ttl {
+			delete(sessionCache.entries, id)
+		}
+	}
+}
+
+// AuthSession is a middleware that checks the access token and rejects revoked sessions
+func AuthSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get the token from the cookie
+		token, err := c.Cookie("ftk")
+		if err != nil || token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized"})
+			return
+		}
+
+		// Verify the token
+		claims, err := VerifyAccessToken(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Authentication failed"})
+			return
+		}
+
+		// Verify the session
+		active, duress, err := CheckSession(claims.SessionID, claims.UserID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong"})
+			return
+		}
+		if !active {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Session revoked"})
+			return
+		}
+
+		// Attach userID, sessionID and the duress flag of the session to the gin context
+		c.Set("userID", claims.UserID)
+		c.Set("sessionID", claims.SessionID)
+		c.Set("duress", duress)
+		c.Next()
+	}
+}
+
+// GetSessionIDFromGin retrieves the session ID from the Gin context
+func GetSessionIDFromGin(c *gin.Context) uuid.UUID {
+	sessionID, exists := c.Get("sessionID")
+	if !exists {
+		return uuid.Nil
+	}
+	return sessionID.(uuid.UUID)
+}
+
+// IsDuressSession reports whether the request comes from a session opened with the duress PIN
+func IsDuressSession(c *gin.Context) bool {
+	return c.GetBool("duress")
+}
@@ -0,0 +1,327 @@
+package helpers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultStuffingWindow        = 15 * time.Minute
+	defaultStuffingBlockDuration = 30 * time.Minute
+	stuffingPurgeInterval        = time.Minute
+)
+
+// StuffingVerdict is the action the credential stuffing detector takes against a client
+type StuffingVerdict int
+
+const (
+	StuffingAllow  StuffingVerdict = iota
+	StuffingStepUp                 // a correct PIN must be confirmed with an OTP
+	StuffingBlock                  // login attempts are rejected
+)
+
+func (v StuffingVerdict) String() string {
+	switch v {
+	case StuffingStepUp:
+		return "step_up"
+	case StuffingBlock:
+		return "block"
+	default:
+		return "allow"
+	}
+}
+
+// StuffingSource identifies the client of a login attempt.
+// The fingerprint is built from the request headers and network, never from the PIN.
+type StuffingSource struct {
+	IP          string
+	DeviceToken string
+	Fingerprint string
+}
+
+// stuffingThresholds are the numbers of distinct phone numbers failed within the window
+// that trigger a step-up challenge and a block
+type stuffingThresholds struct {
+	StepUp int
+	Block  int
+}
+
+// defaultStuffingThresholds are higher for IPs since mobile carriers put many customers behind the same address
+var defaultStuffingThresholds = map[string]stuffingThresholds{
+	"ip":          {StepUp: 10, Block: 30},
+	"device":      {StepUp: 3, Block: 10},
+	"fingerprint": {StepUp: 5, Block: 20},
+}
+
+type stuffingFailure struct {
+	at    time.Time
+	phone string
+}
+
+// stuffingWindow holds the failed logins of one client key
+type stuffingWindow struct {
+	failures     []stuffingFailure
+	reported     StuffingVerdict
+	blockedUntil time.Time
+}
+
+// StuffingDetector aggregates failed logins across accounts by IP, device token and fingerprint
+// over sliding windows. Windows are kept in memory by each replica.
+type StuffingDetector struct {
+	Window        time.Duration
+	BlockDuration time.Duration
+	Thresholds    map[string]stuffingThresholds
+
+	mu        sync.Mutex
+	windows   map[string]*stuffingWindow
+	lastPurge time.Time
+	report    func(detection stuffingDetection)
+}
+
+// stuffingDetection is a key crossing a threshold
+type stuffingDetection struct {
+	Dimension string
+	Source    StuffingSource
+	Phone     string
+	UserID    uuid.UUID
+	Verdict   StuffingVerdict
+	Accounts  int
+	Window    time.Duration
+}
+
+var (
+	stuffing     *StuffingDetector
+	stuffingOnce sync.Once
+)
+
+// Stuffing returns the detector configured from STUFFING_WINDOW, STUFFING_BLOCK_DURATION
+// and STUFFING_<IP|DEVICE|FINGERPRINT>_THRESHOLDS
+func Stuffing() *StuffingDetector {
+	stuffingOnce.Do(func() {
+		stuffing = &StuffingDetector{
+			Window:        defaultStuffingWindow,
+			BlockDuration: defaultStuffingBlockDuration,
+			Thresholds:    make(map[string]stuffingThresholds),
+			windows:       make(map[string]*stuffingWindow),
+			lastPurge:     time.Now(),
+			report:        recordStuffingDetection,
+		}
+		if window, err := time.ParseDuration(os.Getenv("STUFFING_WINDOW")); err == nil && window > 0 {
+			stuffing.Window = window
+		}
+		if duration, err := time.ParseDuration(os.Getenv("STUFFING_BLOCK_DURATION")); err == nil && duration > 0 {
+			stuffing.BlockDuration = duration
+		}
+		for dimension, thresholds := range defaultStuffingThresholds {
+			stuffing.Thresholds[dimension] = parseStuffingThresholds(
+				os.Getenv("STUFFING_"+strings.ToUpper(dimension)+"_THRESHOLDS"), thresholds,
+			)
+		}
+	})
+	return stuffing
+}
+
+// parseStuffingThresholds parses "<step-up>,<block>"
+func parseStuffingThresholds(value string, fallback stuffingThresholds) stuffingThresholds {
+	stepUp, block, found := strings.Cut(value, ",")
+	if !found {
+		return fallback
+	}
+	s, err := strconv.Atoi(strings.TrimSpace(stepUp))
+	if err != nil || s <= 0 {
+		return fallback
+	}
+	b, err := strconv.Atoi(strings.TrimSpace(block))
+	if err != nil || b < s {
+		return fallback
+	}
+	return stuffingThresholds{StepUp: s, Block: b}
+}
+
+// NewStuffingSource builds the source of a login request
+func NewStuffingSource(c *gin.Context, deviceToken string) StuffingSource {
+	ip := c.ClientIP()
+
+	// Group addresses by network so that rotating through a range does not change the fingerprint
+	network := ip
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if v4 := parsed.To4(); v4 != nil {
+			network = v4.Mask(net.CIDRMask(24, 32)).String()
+		} else {
+			network = parsed.Mask(net.CIDRMask(48, 128)).String()
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		c.GetHeader("User-Agent"),
+		c.GetHeader("Accept-Language"),
+		network,
+	}, "|")))
+
+	return StuffingSource{
+		IP:          ip,
+		DeviceToken: strings.TrimSpace(deviceToken),
+		Fingerprint: hex.EncodeToString(sum[:8]),
+	}
+}
+
+// dimensions returns the keys of the source that failures are aggregated by
+func (s StuffingSource) dimensions() map[string]string {
+	dimensions := map[string]string{"ip": s.IP, "fingerprint": s.Fingerprint}
+	if s.DeviceToken != "" {
+		dimensions["device"] = s.DeviceToken
+	}
+	return dimensions
+}
+
+// Check returns the verdict against a source before its login attempt.
+// For a block, it also returns how long the block lasts.
+func (d *StuffingDetector) Check(source StuffingSource) (StuffingVerdict, time.Duration) {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.purge(now)
+
+	verdict := StuffingAllow
+	var retryAfter time.Duration
+	for dimension, value := range source.dimensions() {
+		w, ok := d.windows[dimension+":"+value]
+		if !ok {
+			continue
+		}
+		if w.blockedUntil.After(now) {
+			verdict = StuffingBlock
+			retryAfter = max(retryAfter, w.blockedUntil.Sub(now))
+			continue
+		}
+		if d.level(dimension, w.accounts(now, d.Window)) >= StuffingStepUp && verdict < StuffingStepUp {
+			verdict = StuffingStepUp
+		}
+	}
+	return verdict, retryAfter
+}
+
+// RecordFailure adds a failed login for the phone number to the windows of the source and returns the new verdict.
+// userID is uuid.Nil when the phone number has no account.
+func (d *StuffingDetector) RecordFailure(source StuffingSource, phone string, userID uuid.UUID) StuffingVerdict {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.purge(now)
+
+	verdict := StuffingAllow
+	for dimension, value := range source.dimensions() {
+		key := dimension + ":" + value
+		w, ok := d.windows[key]
+		if !ok {
+			w = &stuffingWindow{}
+			d.windows[key] = w
+		}
+		w.failures = append(w.failures, stuffingFailure{at: now, phone: phone})
+		accounts := w.accounts(now, d.Window)
+		level := d.level(dimension, accounts)
+
+		detected := false
+		switch {
+		case level == StuffingBlock && !w.blockedUntil.After(now):
+			w.blockedUntil = now.Add(d.BlockDuration)
+			detected = true
+		case level == StuffingStepUp && w.reported < StuffingStepUp:
+			detected = true
+		}
+		if detected {
+			w.reported = level
+			d.report(stuffingDetection{
+				Dimension: dimension, Source: source, Phone: phone, UserID: userID,
+				Verdict: level, Accounts: accounts, Window: d.Window,
+			})
+		}
+		verdict = max(verdict, level)
+	}
+	return verdict
+}
+
+// level maps the number of accounts failed from a key to a verdict
+func (d *StuffingDetector) level(dimension string, accounts int) StuffingVerdict {
+	thresholds := d.Thresholds[dimension]
+	switch {
+	case thresholds.Block > 0 && accounts >= thresholds.Block:
+		return StuffingBlock
+	case thresholds.StepUp > 0 && accounts >= thresholds.StepUp:
+		return StuffingStepUp
+	default:
+		return StuffingAllow
+	}
+}
+
+// accounts drops the failures older than the window and counts the distinct phone numbers left
+func (w *stuffingWindow) accounts(now time.Time, window time.Duration) int {
+	start := 0
+	for start < len(w.failures) && now.Sub(w.failures[start].at) > window {
+		start++
+	}
+	w.failures = w.failures[start:]
+	if len(w.failures) == 0 {
+		w.reported = StuffingAllow
+	}
+
+	phones := make(map[string]struct{}, len(w.failures))
+	for _, failure := range w.failures {
+		phones[failure.phone] = struct{}{}
+	}
+	return len(phones)
+}
+
+// purge forgets the windows without failures or block, at most once per purge interval
+func (d *StuffingDetector) purge(now time.Time) {
+	if now.Sub(d.lastPurge) < stuffingPurgeInterval {
+		return
+	}
+	for key, w := range d.windows {
+		if w.accounts(now, d.Window) == 0 && !w.blockedUntil.After(now) {
+			delete(d.windows, key)
+		}
+	}
+	d.lastPurge = now
+}
+
+// recordStuffingDetection counts a detection and records it in the auth logs
+func recordStuffingDetection(d stuffingDetection) {
+	StuffingDetectionsTotal.WithLabelValues(d.Dimension, d.Verdict.String()).Inc()
+	log.Printf("Credential stuffing detected by %s from %s: %d accounts in %s, %s\n", d.Dimension, d.Source.IP, d.Accounts, d.Window, d.Verdict)
+
+	go func() {
+		metadata, _ := json.Marshal(map[string]any{
+			"source":      "login",
+			"dimension":   d.Dimension,
+			"action":      d.Verdict.String(),
+			"accounts":    d.Accounts,
+			"window":      d.Window.String(),
+			"ip_address":  d.Source.IP,
+			"fingerprint": d.Source.Fingerprint,
+		})
+		authLog := models.AuthLog{
+			UserID:      d.UserID,
+			PhoneNumber: d.Phone,
+			DeviceToken: d.Source.DeviceToken,
+			Activity:    "credential_stuffing",
+			Metadata:    string(metadata),
+		}
+		if err := authLog.CreateAuthLog(); err != nil {
+			log.Printf("Error creating auth log: %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,223 @@
+package helpers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// newTestStuffingDetector returns a detector that steps up devices at 2 phone numbers and blocks them at 4,
+// with thresholds out of reach for IPs and fingerprints, and keeps the detections it reports
+func newTestStuffingDetector(detections *[]stuffingDetection) *StuffingDetector {
+	return &StuffingDetector{
+		Window:        15 * time.Minute,
+		BlockDuration: 30 * time.Minute,
+		Thresholds: map[string]stuffingThresholds{
+			"ip":          {StepUp: 100, Block: 200},
+			"device":      {StepUp: 2, Block: 4},
+			"fingerprint": {StepUp: 100, Block: 200},
+		},
+		windows:   make(map[string]*stuffingWindow),
+		lastPurge: time.Now(),
+		report: func(detection stuffingDetection) {
+			*detections = append(*detections, detection)
+		},
+	}
+}
+
+var testStuffingSource = StuffingSource{IP: "192.0.2.1", DeviceToken: "device", Fingerprint: "fingerprint"}
+
+// failPhones records a failed login for each of n distinct phone numbers
+func failPhones(d *StuffingDetector, source StuffingSource, n int) StuffingVerdict {
+	verdict := StuffingAllow
+	for i := 0; i < n; i++ {
+		verdict = d.RecordFailure(source, fmt.Sprintf("+22500000000%02d", i), uuid.Nil)
+	}
+	return verdict
+}
+
+func TestStuffingThresholds(t *testing.T) {
+	var detections []stuffingDetection
+	d := newTestStuffingDetector(&detections)
+
+	steps := []struct {
+		phone   string
+		verdict StuffingVerdict
+	}{
+		{"+2250000000001", StuffingAllow},
+		{"+2250000000001", StuffingAllow}, // the same number again does not count
+		{"+2250000000002", StuffingStepUp},
+		{"+2250000000003", StuffingStepUp},
+		{"+2250000000004", StuffingBlock},
+	}
+	for i, step := range steps {
+		if got := d.RecordFailure(testStuffingSource, step.phone, uuid.Nil); got != step.verdict {
+			t.Fatalf("failure %d: got %s, want %s", i+1, got, step.verdict)
+		}
+	}
+
+	verdict, retryAfter := d.Check(testStuffingSource)
+	if verdict != StuffingBlock {
+		t.Fatalf("expected the source to be blocked, got %s", verdict)
+	}
+	if retryAfter <= 29*time.Minute || retryAfter > d.BlockDuration {
+		t.Errorf("expected the block to last about %s, got %s", d.BlockDuration, retryAfter)
+	}
+
+	// Each level is reported once, by the device dimension only
+	if len(detections) != 2 {
+		t.Fatalf("expected 2 detections, got %d", len(detections))
+	}
+	for i, want := range []StuffingVerdict{StuffingStepUp, StuffingBlock} {
+		if detections[i].Dimension != "device" || detections[i].Verdict != want {
+			t.Errorf("detection %d: got %s by %s, want %s by device", i+1,
+				detections[i].Verdict, detections[i].Dimension, want)
+		}
+	}
+}
+
+func TestStuffingCheckStepUp(t *testing.T) {
+	var detections []stuffingDetection
+	d := newTestStuffingDetector(&detections)
+
+	if verdict, _ := d.Check(testStuffingSource); verdict != StuffingAllow {
+		t.Fatalf("expected a new source to be allowed, got %s", verdict)
+	}
+	failPhones(d, testStuffingSource, 2)
+	if verdict, retryAfter := d.Check(testStuffingSource); verdict != StuffingStepUp || retryAfter != 0 {
+		t.Errorf("expected a step-up, got %s after %s", verdict, retryAfter)
+	}
+
+	// Another device from the same IP is not affected
+	other := testStuffingSource
+	other.DeviceToken = "other"
+	if verdict, _ := d.Check(other); verdict != StuffingAllow {
+		t.Errorf("expected another device to be allowed, got %s", verdict)
+	}
+
+	// Without a device token, the device dimension is not tracked
+	anonymous := testStuffingSource
+	anonymous.DeviceToken = ""
+	if verdict := failPhones(d, anonymous, 5); verdict != StuffingAllow {
+		t.Errorf("expected a source without device token to be allowed, got %s", verdict)
+	}
+}
+
+func TestStuffingWindowSlides(t *testing.T) {
+	var detections []stuffingDetection
+	d := newTestStuffingDetector(&detections)
+	failPhones(d, testStuffingSource, 3)
+
+	// Move the failures out of the window
+	d.mu.Lock()
+	w := d.windows["device:"+testStuffingSource.DeviceToken]
+	for i := range w.failures {
+		w.failures[i].at = w.failures[i].at.Add(-d.Window - time.Second)
+	}
+	d.mu.Unlock()
+
+	if verdict, _ := d.Check(testStuffingSource); verdict != StuffingAllow {
+		t.Fatalf("expected failures out of the window to be dropped, got %s", verdict)
+	}
+
+	// The step-up is reported again once the window has emptied
+	if verdict := failPhones(d, testStuffingSource, 2); verdict != StuffingStepUp {
+		t.Fatalf("expected a step-up, got %s", verdict)
+	}
+	if len(detections) != 2 {
+		t.Errorf("expected the step-up to be reported twice, got %d detections", len(detections))
+	}
+}
+
+func TestStuffingBlockExpires(t *testing.T) {
+	var detections []stuffingDetection
+	d := newTestStuffingDetector(&detections)
+	failPhones(d, testStuffingSource, 4)
+
+	// The block outlasts the window of failures
+	d.mu.Lock()
+	w := d.windows["device:"+testStuffingSource.DeviceToken]
+	for i := range w.failures {
+		w.failures[i].at = w.failures[i].at.Add(-d.Window - time.Second)
+	}
+	d.mu.Unlock()
+	if verdict, _ := d.Check(testStuffingSource); verdict != StuffingBlock {
+		t.Fatalf("expected the block to hold after the window, got %s", verdict)
+	}
+
+	d.mu.Lock()
+	w.blockedUntil = time.Now().Add(-time.Second)
+	d.lastPurge = time.Now().Add(-stuffingPurgeInterval)
+	d.mu.Unlock()
+	if verdict, _ := d.Check(testStuffingSource); verdict != StuffingAllow {
+		t.Fatalf("expected the source to be allowed once the block expired, got %s", verdict)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.windows["device:"+testStuffingSource.DeviceToken]; ok {
+		t.Error("expected the expired window to be purged")
+	}
+}
+
+func TestParseStuffingThresholds(t *testing.T) {
+	fallback := stuffingThresholds{StepUp: 3, Block: 10}
+	tests := []struct {
+		value string
+		want  stuffingThresholds
+	}{
+		{"5,20", stuffingThresholds{StepUp: 5, Block: 20}},
+		{" 5 , 5 ", stuffingThresholds{StepUp: 5, Block: 5}},
+		{"", fallback},
+		{"5", fallback},
+		{"0,10", fallback},
+		{"10,5", fallback},
+		{"x,10", fallback},
+		{"5,x", fallback},
+	}
+	for _, tt := range tests {
+		if got := parseStuffingThresholds(tt.value, fallback); got != tt.want {
+			t.Errorf("parseStuffingThresholds(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestStuffingSourceIgnoresSpoofedIP checks that a client rotating X-Forwarded-For keeps the same source
+// when it does not come through a trusted proxy
+func TestStuffingSourceIgnoresSpoofedIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	engine := gin.New()
+	if err := engine.SetTrustedProxies(TrustedProxies()); err != nil {
+		t.Fatal(err)
+	}
+	var sources []StuffingSource
+	engine.POST("/login", func(c *gin.Context) {
+		sources = append(sources, NewStuffingSource(c, "device"))
+	})
+
+	send := func(remoteAddr, forwardedFor string) StuffingSource {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("User-Agent", "test")
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		engine.ServeHTTP(httptest.NewRecorder(), req)
+		return sources[len(sources)-1]
+	}
+
+	first := send("192.0.2.1:4000", "203.0.113.1")
+	second := send("192.0.2.1:4000", "198.51.100.2")
+	if first.IP != "192.0.2.1" || first != second {
+		t.Errorf("got sources %+v and %+v, want the peer address for both", first, second)
+	}
+
+	// Behind a trusted proxy, the forwarded address is the client
+	if proxied := send("10.1.2.3:4000", "203.0.113.1"); proxied.IP != "203.0.113.1" {
+		t.Errorf("got IP %s behind a trusted proxy, want the forwarded one", proxied.IP)
+	}
+}
@@ -0,0 +1,70 @@
+package helpers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RefreshCookieName      = "frt"
+	refreshCookiePath      = "/api/v1"
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// RefreshTokenTTL returns the refresh token lifetime from REFRESH_TOKEN_TTL
+func RefreshTokenTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return defaultRefreshTokenTTL
+}
+
+// GenerateRefreshToken generates an opaque random refresh token
+func GenerateRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken hashes an opaque token before it is stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetRefreshCookie sets the refresh token in a cookie scoped to the API
+func SetRefreshCookie(c *gin.Context, token string, domain string) {
+	http.SetCookie(c.Writer, refreshCookie(c, token, domain, int(RefreshTokenTTL().Seconds())))
+}
+
+// ClearRefreshCookie clears the refresh token cookie
+func ClearRefreshCookie(c *gin.Context, domain string) {
+	http.SetCookie(c.Writer, refreshCookie(c, "", domain, -1))
+}
+
+// refreshCookie builds the refresh cookie with the same settings as the auth cookie
+func refreshCookie(c *gin.Context, token string, domain string, maxAge int) *http.Cookie {
+	sameSite := http.SameSiteNoneMode
+	if domain == "localhost" {
+		sameSite = http.SameSiteLaxMode
+	}
+	return &http.Cookie{
+		Name:     RefreshCookieName,
+		Value:    token,
+		Path:     refreshCookiePath,
+		Domain:   domain,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: sameSite,
+		Secure:   c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https",
+	}
+}
@@ -0,0 +1,51 @@
+package helpers
+
+import (
+	"sync"
+
+	"github.com/emmadal/feeti-auth/walletclient"
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	walletClient   walletclient.Client
+	walletBreaker  *walletclient.Breaker
+	walletClientMu sync.RWMutex
+)
+
+// WalletClient returns the wallet service client. It is set up once NATS is connected.
+func WalletClient() walletclient.Client {
+	walletClientMu.RLock()
+	defer walletClientMu.RUnlock()
+	if walletClient == nil {
+		return walletclient.New(nil, walletclient.Config{})
+	}
+	return walletClient
+}
+
+// SetWalletClient replaces the wallet service client, for example with a fake in tests
+func SetWalletClient(client walletclient.Client) {
+	walletClientMu.Lock()
+	defer walletClientMu.Unlock()
+	walletClient = client
+	walletBreaker, _ = client.(*walletclient.Breaker)
+}
+
+// newWalletClient returns the wallet client behind a circuit breaker that reports its state to metrics
+func newWalletClient(conn *nats.Conn) walletclient.Client {
+	config := walletclient.BreakerConfigFromEnv()
+	config.OnStateChange = func(state walletclient.State) {
+		WalletBreakerState.Set(float64(state))
+	}
+	return walletclient.NewBreaker(walletclient.New(conn, walletclient.ConfigFromEnv()), config)
+}
+
+// WalletBreakerStatus returns the state of the wallet circuit breaker, "closed" when there is none
+func WalletBreakerStatus() string {
+	walletClientMu.RLock()
+	defer walletClientMu.RUnlock()
+	if walletBreaker == nil {
+		return walletclient.StateClosed.String()
+	}
+	return walletBreaker.State().String()
+}
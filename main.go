@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	jwt "github.com/emmadal/feeti-module/auth"
 	"log"
 	"net/http"
 	"os"
@@ -51,6 +50,11 @@ func main() {
 	// Initialize Gin server
 	server := gin.Default()
 
+	// Client IPs key rate limits and credential stuffing detection, only take them from trusted proxies
+	if err := server.SetTrustedProxies(helpers.TrustedProxies()); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v\n", err)
+	}
+
 	// middleware
 	server.Use(
 		cors.New(
@@ -81,25 +85,58 @@ func main() {
 	}
 
 	// v1 routes
-	jwtKey := []byte(os.Getenv("JWT_KEY"))
-	v1.POST("/register", controllers.Register)
-	v1.POST("/login", controllers.Login)
+	v1.POST("/register", helpers.RateLimit("register"), controllers.Register)
+	v1.POST("/register/confirm", helpers.RateLimit("register-confirm"), controllers.ConfirmRegister)
+	v1.POST("/login", helpers.RateLimit("login"), controllers.Login)
+	v1.POST("/forgot-pin", helpers.RateLimit("forgot-pin"), controllers.ForgotPin)
+	v1.POST("/reset-pin", helpers.RateLimit("reset-pin"), controllers.ResetPin)
+	v1.POST("/unlock/request", helpers.RateLimit("unlock-request"), controllers.UnlockRequest)
+	v1.POST("/unlock/confirm", helpers.RateLimit("unlock-confirm"), controllers.UnlockConfirm)
+	v1.POST("/token/refresh", helpers.RateLimit("token-refresh"), controllers.RefreshToken)
 	v1.GET("/healthz", controllers.HealthCheck)
-	v1.POST("/update-pin", jwt.AuthGin(jwtKey), controllers.UpdatePin)
-	v1.POST("/remove-account", jwt.AuthGin(jwtKey), controllers.RemoveAccount)
-	v1.POST("/sign-out", jwt.AuthGin(jwtKey), controllers.SignOut)
+	v1.POST("/update-pin", helpers.RateLimit("update-pin"), helpers.AuthSession(), controllers.UpdatePin)
+	v1.POST("/remove-account", helpers.RateLimit("remove-account"), helpers.AuthSession(), controllers.RemoveAccount)
+	v1.POST("/duress-pin", helpers.RateLimit("duress-pin"), helpers.AuthSession(), controllers.SetDuressPin)
+	v1.POST("/duress-pin/remove", helpers.RateLimit("duress-pin"), helpers.AuthSession(), controllers.RemoveDuressPin)
+	v1.POST("/sign-out", helpers.AuthSession(), controllers.SignOut)
+	v1.GET("/sessions", helpers.AuthSession(), controllers.ListSessions)
+	v1.POST("/sessions/revoke-all", helpers.AuthSession(), controllers.RevokeAllSessions)
 	v1.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	server.GET("/.well-known/jwks.json", controllers.JWKS)
+
+	// Load the PIN hashing policy and pepper
+	if err := helpers.LoadPasswordHashing(); err != nil {
+		log.Fatalf("Failed to load PIN hashing: %v\n", err)
+	}
+	if err := helpers.CheckOTPSecret(); err != nil {
+		log.Fatalf("Invalid OTP secret: %v\n", err)
+	}
+
+	// Load the token signing keys and watch for rotations
+	helpers.StartKeyRotation()
 
 	// Subscription is now handled inside NatsConnect
 	if err := helpers.NatsConnect(); err != nil {
 		log.Printf("Failed to connect to NATS: %v\n", err)
 	}
 
+	// Purge stale session cache entries
+	go func() {
+		for range time.Tick(time.Minute) {
+			helpers.PurgeSessionCache()
+		}
+	}()
+
 	// start server
 	go func() {
 		// Database connection
 		models.DBConnect()
 
+		// Relay outbox messages and reconcile registrations once the database is ready
+		helpers.StartOutboxRelay()
+		helpers.StartRegistrationReconciler()
+		helpers.StartLockoutSweeper()
+
 		_, err := fmt.Fprintf(os.Stdout, "Server started on port %s\n", port)
 		if err != nil {
 			log.Fatalln("Error writing to stdout")
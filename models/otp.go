@@ -0,0 +1,178 @@
+package models
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// OTP purposes
+const (
+	OTPPurposeResetPin = "reset_pin"
+	OTPPurposeRegister = "register"
+	OTPPurposeUnlock   = "unlock"
+	OTPPurposeLogin    = "login"
+
+	// OTPPurposeAccountExists records a notice sent instead of a registration code to a registered number
+	OTPPurposeAccountExists = "account_exists"
+)
+
+var (
+	ErrOTPNotFound  = errors.New("otp not found")
+	ErrOTPExpired   = errors.New("otp expired")
+	ErrOTPUsed      = errors.New("otp already used")
+	ErrOTPExhausted = errors.New("otp attempts exhausted")
+	ErrOTPInvalid   = errors.New("otp invalid")
+)
+
+// OTP is the struct for a one-time password bound to a key UID
+type OTP struct {
+	KeyUID      uuid.UUID  `json:"key_uid" db:"key_uid"`
+	PhoneNumber string     `json:"phone_number" db:"phone_number"`
+	Purpose     string     `json:"purpose" db:"purpose"`
+	CodeHash    string     `json:"-" db:"code_hash"`
+	Attempts    int        `json:"attempts" db:"attempts"`
+	MaxAttempts int        `json:"max_attempts" db:"max_attempts"`
+	ExpiresAt   time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt      *time.Time `json:"used_at" db:"used_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at,omitempty"`
+}
+
+// ForgotPin is the struct to request a PIN reset code
+type ForgotPin struct {
+	PhoneNumber string `json:"phone_number" binding:"required,e164"`
+}
+
+// UnlockRequest is the struct to request an account unlock code
+type UnlockRequest struct {
+	PhoneNumber string `json:"phone_number" binding:"required,e164"`
+}
+
+// UnlockConfirm is the struct to unlock an account with the code
+type UnlockConfirm struct {
+	PhoneNumber string `json:"phone_number" binding:"required,e164"`
+	CodeOTP     string `json:"code_otp" binding:"required,len=5,numeric"`
+	KeyUID      string `json:"key_uid" binding:"required,uuid"`
+}
+
+// CountOTPs counts the codes issued for a phone number and purpose since the given time
+func CountOTPs(phone, purpose string, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var count int
+	err := DB.QueryRow(
+		ctx,
+		`SELECT COUNT(*) FROM otp_codes WHERE phone_number = $1 AND purpose = $2 AND created_at > $3`,
+		phone, purpose, since,
+	).Scan(&count)
+	return count, err
+}
+
+// CreateOTP stores a new OTP and invalidates the pending ones for the same phone number and purpose
+func (o *OTP) CreateOTP() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE otp_codes SET used_at = CURRENT_TIMESTAMP
+         WHERE phone_number = $1 AND purpose = $2 AND used_at IS NULL`,
+		o.PhoneNumber, o.Purpose,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO otp_codes (phone_number, purpose, code_hash, max_attempts, expires_at)
+         VALUES ($1, $2, $3, $4, $5)
+         RETURNING key_uid, created_at`,
+		o.PhoneNumber, o.Purpose, o.CodeHash, o.MaxAttempts, o.ExpiresAt,
+	).Scan(&o.KeyUID, &o.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// VerifyOTP checks the code hash against the stored OTP and consumes it on success.
+// A wrong code increments the attempt counter.
+func (o *OTP) VerifyOTP() error {
+	return o.verify(true)
+}
+
+// MatchOTP checks the code hash against the stored OTP like VerifyOTP, but leaves a matching code usable
+func (o *OTP) MatchOTP() error {
+	return o.verify(false)
+}
+
+// verify checks the code hash against the stored OTP, and consumes it on success when consume is set
+func (o *OTP) verify(consume bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	var stored OTP
+	err = tx.QueryRow(
+		ctx,
+		`SELECT code_hash, attempts, max_attempts, expires_at, used_at FROM otp_codes
+         WHERE key_uid = $1 AND phone_number = $2 AND purpose = $3 FOR UPDATE`,
+		o.KeyUID, o.PhoneNumber, o.Purpose,
+	).Scan(&stored.CodeHash, &stored.Attempts, &stored.MaxAttempts, &stored.ExpiresAt, &stored.UsedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrOTPNotFound
+		}
+		return err
+	}
+
+	switch {
+	case stored.UsedAt != nil:
+		return ErrOTPUsed
+	case time.Now().After(stored.ExpiresAt):
+		return ErrOTPExpired
+	case stored.Attempts >= stored.MaxAttempts:
+		return ErrOTPExhausted
+	}
+
+	if subtle.ConstantTimeCompare([]byte(stored.CodeHash), []byte(o.CodeHash)) != 1 {
+		if _, err := tx.Exec(ctx, `UPDATE otp_codes SET attempts = attempts + 1 WHERE key_uid = $1`, o.KeyUID); err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+		return ErrOTPInvalid
+	}
+	if !consume {
+		return nil
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE otp_codes SET used_at = CURRENT_TIMESTAMP WHERE key_uid = $1`, o.KeyUID); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
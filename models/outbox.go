@@ -0,0 +1,192 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Outbox message kinds
+const (
+	OutboxKindEvent   = "event"   // published to JetStream
+	OutboxKindCommand = "command" // sent as a NATS request and acknowledged by the reply
+)
+
+// outboxRelayLockID is the advisory lock held by the replica relaying the outbox
+const outboxRelayLockID int64 = 0x6f7574626f78
+
+var ErrOutboxMessageNotFound = errors.New("outbox message not found")
+
+// OutboxMessage is a message written in the same transaction as the change it describes,
+// and delivered to NATS afterwards by the relay
+type OutboxMessage struct {
+	ID            uuid.UUID  `json:"id" db:"id"`
+	Kind          string     `json:"kind" db:"kind"`
+	Subject       string     `json:"subject" db:"subject"`
+	Payload       []byte     `json:"payload" db:"payload"`
+	Attempts      int        `json:"attempts" db:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" db:"next_attempt_at"`
+	LastError     *string    `json:"last_error" db:"last_error"`
+	DeliveredAt   *time.Time `json:"delivered_at" db:"delivered_at"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at,omitempty"`
+}
+
+// OutboxRelay configures a relay pass
+type OutboxRelay struct {
+	BatchSize   int
+	MaxAttempts int
+	// Lease is how long claimed messages are kept from other deliveries. It must outlast the delivery of a batch.
+	Lease   time.Duration
+	Deliver func(msg OutboxMessage) error
+	Backoff func(attempts int) time.Duration
+}
+
+// insertOutbox writes messages in the caller's transaction
+func insertOutbox(ctx context.Context, tx pgx.Tx, messages []OutboxMessage) error {
+	for _, msg := range messages {
+		_, err := tx.Exec(
+			ctx,
+			`INSERT INTO outbox (id, kind, subject, payload) VALUES ($1, $2, $3, $4)`,
+			msg.ID, msg.Kind, msg.Subject, msg.Payload,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnqueueOutbox writes messages that are not tied to another change
+func EnqueueOutbox(messages ...OutboxMessage) error {
+	_, err := WithTransaction(
+		DB, func(tx pgx.Tx) (any, error) {
+			return nil, insertOutbox(context.Background(), tx, messages)
+		},
+	)
+	return err
+}
+
+// Relay delivers a batch of pending messages and returns how many were attempted. Only the replica holding the advisory lock relays,
+// the others return right away. A failed message is retried after the backoff until MaxAttempts.
+// Messages are claimed for the lease and delivered outside any transaction, and each outcome is saved on its own,
+// so that slow deliveries neither hold row locks nor lose the attempts made before a timeout.
+func (r OutboxRelay) Relay() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The lock is held by the connection until the pass ends
+	conn, err := DB.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, outboxRelayLockID).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+	defer func() {
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if _, err := conn.Exec(unlockCtx, `SELECT pg_advisory_unlock($1)`, outboxRelayLockID); err != nil {
+			// Closing the connection releases the lock, the pool then replaces it
+			_ = conn.Conn().Close(unlockCtx)
+		}
+	}()
+
+	rows, err := conn.Query(
+		ctx,
+		`UPDATE outbox SET next_attempt_at = $3
+         WHERE id IN (
+             SELECT id FROM outbox
+             WHERE delivered_at IS NULL AND attempts < $1 AND next_attempt_at <= CURRENT_TIMESTAMP
+             ORDER BY created_at
+             LIMIT $2
+             FOR UPDATE SKIP LOCKED
+         )
+         RETURNING id, kind, subject, payload, attempts, created_at`,
+		r.MaxAttempts, r.BatchSize, time.Now().Add(r.Lease),
+	)
+	if err != nil {
+		return 0, err
+	}
+	messages, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (OutboxMessage, error) {
+		var msg OutboxMessage
+		err := row.Scan(&msg.ID, &msg.Kind, &msg.Subject, &msg.Payload, &msg.Attempts, &msg.CreatedAt)
+		return msg, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+	})
+
+	for _, msg := range messages {
+		if err := r.record(msg, r.Deliver(msg)); err != nil {
+			return 0, err
+		}
+	}
+	return len(messages), nil
+}
+
+// DeliverOutboxMessage delivers a single pending message right away, so that a request can use the reply.
+// It returns ErrOutboxMessageNotFound when the message is already delivered, being relayed or waiting for a retry.
+func (r OutboxRelay) DeliverOutboxMessage(id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var msg OutboxMessage
+	err := DB.QueryRow(
+		ctx,
+		`UPDATE outbox SET next_attempt_at = $2
+         WHERE id = $1 AND delivered_at IS NULL AND next_attempt_at <= CURRENT_TIMESTAMP
+         RETURNING id, kind, subject, payload, attempts`,
+		id, time.Now().Add(r.Lease),
+	).Scan(&msg.ID, &msg.Kind, &msg.Subject, &msg.Payload, &msg.Attempts)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrOutboxMessageNotFound
+		}
+		return err
+	}
+
+	deliverErr := r.Deliver(msg)
+	if err := r.record(msg, deliverErr); err != nil {
+		return err
+	}
+	return deliverErr
+}
+
+// record marks a message delivered, or schedules the next attempt
+func (r OutboxRelay) record(msg OutboxMessage, deliverErr error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if deliverErr == nil {
+		_, err := DB.Exec(ctx, `UPDATE outbox SET delivered_at = CURRENT_TIMESTAMP, last_error = NULL WHERE id = $1`, msg.ID)
+		return err
+	}
+	_, err := DB.Exec(
+		ctx,
+		`UPDATE outbox SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3 WHERE id = $1`,
+		msg.ID, deliverErr.Error(), time.Now().Add(r.Backoff(msg.Attempts+1)),
+	)
+	return err
+}
+
+// PurgeOutbox deletes the messages delivered before the given time
+func PurgeOutbox(before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := DB.Exec(ctx, `DELETE FROM outbox WHERE delivered_at < $1`, before)
+	return err
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// MaxPinHistory is the number of previous PINs kept per user
+const MaxPinHistory = 24
+
+// savePinHistory stores the current PIN hash of the user before it is replaced and drops the oldest entries
+func savePinHistory(ctx context.Context, tx pgx.Tx, phoneNumber string) error {
+	var userID uuid.UUID
+	err := tx.QueryRow(
+		ctx,
+		`INSERT INTO pin_history (user_id, pin_hash)
+         SELECT id, pin FROM users WHERE phone_number = $1 AND is_active = true
+         RETURNING user_id`,
+		phoneNumber,
+	).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`DELETE FROM pin_history WHERE user_id = $1 AND id NOT IN (
+            SELECT id FROM pin_history WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2
+         )`,
+		userID, MaxPinHistory,
+	)
+	return err
+}
+
+// GetPinHistory returns the hashes of the previous PINs of a user, most recent first
+func GetPinHistory(userID uuid.UUID, limit int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	rows, err := DB.Query(
+		ctx,
+		`SELECT pin_hash FROM pin_history WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2`,
+		userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
@@ -0,0 +1,134 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenExpired  = errors.New("refresh token expired")
+	ErrRefreshTokenRevoked  = errors.New("refresh token revoked")
+	ErrRefreshTokenReused   = errors.New("refresh token reused")
+)
+
+// RefreshToken is a single-use token belonging to a rotation family
+type RefreshToken struct {
+	ID        uuid.UUID  `json:"id" db:"id,omitempty"`
+	UserID    uuid.UUID  `json:"user_id" db:"user_id"`
+	FamilyID  uuid.UUID  `json:"family_id" db:"family_id"`
+	TokenHash string     `json:"-" db:"token_hash"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt    *time.Time `json:"used_at" db:"used_at"`
+	RevokedAt *time.Time `json:"revoked_at" db:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at,omitempty"`
+}
+
+// RefreshTokenRequest is the struct to refresh an access token
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// CreateRefreshToken stores the first refresh token of a family. The family ID is the session ID.
+func (t *RefreshToken) CreateRefreshToken() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	return DB.QueryRow(
+		ctx,
+		`INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+         VALUES ($1, $2, $3, $4) RETURNING id, created_at`,
+		t.UserID, t.FamilyID, t.TokenHash, t.ExpiresAt,
+	).Scan(&t.ID, &t.CreatedAt)
+}
+
+// RotateRefreshToken consumes the refresh token matching oldHash and stores its successor in the same family.
+// Presenting a token that was already used revokes the whole family. Tokens of a revoked or expired session,
+// or of a locked or inactive account, are not found.
+func RotateRefreshToken(oldHash, newHash string, expiresAt time.Time) (*RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	var current RefreshToken
+	err = tx.QueryRow(
+		ctx,
+		`SELECT rt.id, rt.user_id, rt.family_id, rt.expires_at, rt.used_at, rt.revoked_at
+         FROM refresh_tokens rt JOIN users u ON u.id = rt.user_id
+         JOIN sessions s ON s.id = rt.family_id
+         WHERE rt.token_hash = $1 AND u.is_active = true AND u.locked = false
+             AND s.revoked_at IS NULL AND s.expires_at > CURRENT_TIMESTAMP
+         FOR UPDATE OF rt`,
+		oldHash,
+	).Scan(&current.ID, &current.UserID, &current.FamilyID, &current.ExpiresAt, &current.UsedAt, &current.RevokedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrRefreshTokenNotFound
+		}
+		return nil, err
+	}
+
+	switch {
+	case current.RevokedAt != nil:
+		return nil, ErrRefreshTokenRevoked
+	case current.UsedAt != nil:
+		// The token was already rotated: someone else holds a copy, revoke the family and its session
+		_, err := tx.Exec(
+			ctx,
+			`UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE family_id = $1 AND revoked_at IS NULL`,
+			current.FamilyID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(
+			ctx, `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL`,
+			current.FamilyID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return nil, err
+		}
+		return &current, ErrRefreshTokenReused
+	case time.Now().After(current.ExpiresAt):
+		return nil, ErrRefreshTokenExpired
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = $1`, current.ID); err != nil {
+		return nil, err
+	}
+
+	next := RefreshToken{
+		UserID:    current.UserID,
+		FamilyID:  current.FamilyID,
+		TokenHash: newHash,
+		ExpiresAt: expiresAt,
+	}
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+         VALUES ($1, $2, $3, $4) RETURNING id, created_at`,
+		next.UserID, next.FamilyID, next.TokenHash, next.ExpiresAt,
+	).Scan(&next.ID, &next.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrPendingRegistrationNotFound = errors.New("pending registration not found")
+
+// PendingRegistration is a registration waiting for phone ownership verification
+type PendingRegistration struct {
+	KeyUID      uuid.UUID `json:"key_uid" db:"key_uid"`
+	FirstName   string    `json:"first_name" db:"first_name"`
+	LastName    string    `json:"last_name" db:"last_name"`
+	PhoneNumber string    `json:"phone_number" db:"phone_number"`
+	DeviceToken string    `json:"device_token" db:"device_token"`
+	Pin         string    `json:"-" db:"pin"`
+	PinLength   int       `json:"-" db:"pin_length"`
+	ExpiresAt   time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at,omitempty"`
+}
+
+// ConfirmRegistration is the struct to confirm a pending registration
+type ConfirmRegistration struct {
+	PhoneNumber string `json:"phone_number" binding:"required,e164"`
+	CodeOTP     string `json:"code_otp" binding:"required,len=5,numeric"`
+	KeyUID      string `json:"key_uid" binding:"required,uuid"`
+}
+
+// CreatePendingRegistration stores a pending registration
+func (p *PendingRegistration) CreatePendingRegistration() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err := DB.Exec(
+		ctx,
+		`INSERT INTO pending_registrations (key_uid, first_name, last_name, phone_number, device_token, pin, pin_length,
+         expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		p.KeyUID, p.FirstName, p.LastName, p.PhoneNumber, p.DeviceToken, p.Pin, p.PinLength, p.ExpiresAt,
+	)
+	return err
+}
+
+// GetPendingRegistration finds a pending registration that has not expired yet
+func GetPendingRegistration(keyUID uuid.UUID, phone string) (*PendingRegistration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var p PendingRegistration
+	err := DB.QueryRow(
+		ctx,
+		`SELECT key_uid, first_name, last_name, phone_number, device_token, pin, pin_length, expires_at, created_at
+         FROM pending_registrations
+         WHERE key_uid = $1 AND phone_number = $2 AND expires_at > CURRENT_TIMESTAMP`,
+		keyUID, phone,
+	).Scan(
+		&p.KeyUID, &p.FirstName, &p.LastName, &p.PhoneNumber, &p.DeviceToken, &p.Pin, &p.PinLength, &p.ExpiresAt,
+		&p.CreatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrPendingRegistrationNotFound
+		}
+		return nil, err
+	}
+	return &p, nil
+}
+
+// DeletePendingRegistration removes a pending registration once it is confirmed
+func (p *PendingRegistration) DeletePendingRegistration() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err := DB.Exec(ctx, `DELETE FROM pending_registrations WHERE key_uid = $1`, p.KeyUID)
+	return err
+}
+
+// CountPendingRegistrations counts the registrations started for a phone number since the given time
+func CountPendingRegistrations(phone string, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var count int
+	err := DB.QueryRow(
+		ctx,
+		`SELECT COUNT(*) FROM pending_registrations WHERE phone_number = $1 AND created_at > $2`,
+		phone, since,
+	).Scan(&count)
+	return count, err
+}
+
+// PurgePendingRegistrations removes pending registrations created before the given time
+func PurgePendingRegistrations(before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err := DB.Exec(ctx, `DELETE FROM pending_registrations WHERE created_at < $1`, before)
+	return err
+}
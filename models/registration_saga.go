@@ -0,0 +1,246 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Registration saga states. A saga moves forward through the steps, or to compensating then rolled_back.
+const (
+	SagaUserCreated     = "user_created"
+	SagaWalletRequested = "wallet_requested"
+	SagaWalletConfirmed = "wallet_confirmed"
+	SagaSessionIssued   = "session_issued"
+	SagaCompleted       = "completed"
+	SagaCompensating    = "compensating"
+	SagaRolledBack      = "rolled_back"
+)
+
+// registrationReconcilerLockID is the advisory lock held by the replica reconciling registrations
+const registrationReconcilerLockID int64 = 0x7361676173
+
+var ErrRegistrationSagaNotFound = errors.New("registration saga not found")
+
+// RegistrationSaga tracks the steps of a confirmed registration so that a registration
+// interrupted halfway is either finished or rolled back
+type RegistrationSaga struct {
+	ID            uuid.UUID  `json:"id" db:"id"`
+	UserID        uuid.UUID  `json:"user_id" db:"user_id"`
+	PendingKeyUID uuid.UUID  `json:"pending_key_uid" db:"pending_key_uid"`
+	State         string     `json:"state" db:"state"`
+	WalletID      *uuid.UUID `json:"wallet_id" db:"wallet_id"`
+	SessionID     *uuid.UUID `json:"session_id" db:"session_id"`
+	Attempts      int        `json:"attempts" db:"attempts"`
+	LastError     *string    `json:"last_error" db:"last_error"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at,omitempty"`
+}
+
+// StartRegistrationSaga creates the user and its saga in the same transaction
+func StartRegistrationSaga(user *User, pendingKeyUID uuid.UUID) (*RegistrationSaga, *User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	newUser, err := user.insertUser(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	saga := RegistrationSaga{UserID: newUser.ID, PendingKeyUID: pendingKeyUID, State: SagaUserCreated}
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO registration_sagas (user_id, pending_key_uid, state) VALUES ($1, $2, $3)
+         RETURNING id, created_at, updated_at`,
+		saga.UserID, saga.PendingKeyUID, saga.State,
+	).Scan(&saga.ID, &saga.CreatedAt, &saga.UpdatedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, err
+	}
+	return &saga, newUser, nil
+}
+
+// Advance moves the saga to a new state and stores its wallet, session and last error.
+// Each move to wallet_requested counts as an attempt.
+func (s *RegistrationSaga) Advance(state string, cause error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var lastError *string
+	if cause != nil {
+		message := cause.Error()
+		lastError = &message
+	}
+
+	err := DB.QueryRow(
+		ctx,
+		`UPDATE registration_sagas
+         SET state = $2, wallet_id = $3, session_id = $4, last_error = $5,
+             attempts = attempts + CASE WHEN $2 = 'wallet_requested' THEN 1 ELSE 0 END,
+             updated_at = CURRENT_TIMESTAMP
+         WHERE id = $1
+         RETURNING attempts, updated_at`,
+		s.ID, state, s.WalletID, s.SessionID, lastError,
+	).Scan(&s.Attempts, &s.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrRegistrationSagaNotFound
+		}
+		return err
+	}
+	s.State = state
+	s.LastError = lastError
+	return nil
+}
+
+// RecordFailure stores the error of the current step without changing the state or counting an attempt
+func (s *RegistrationSaga) RecordFailure(cause error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	message := cause.Error()
+	err := DB.QueryRow(
+		ctx,
+		`UPDATE registration_sagas SET last_error = $2, updated_at = CURRENT_TIMESTAMP
+         WHERE id = $1
+         RETURNING updated_at`,
+		s.ID, message,
+	).Scan(&s.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrRegistrationSagaNotFound
+		}
+		return err
+	}
+	s.LastError = &message
+	return nil
+}
+
+// Complete ends the saga, drops the pending registration and writes the outbox messages in one transaction
+func (s *RegistrationSaga) Complete(outbox ...OutboxMessage) error {
+	return s.finish(SagaCompleted, nil, outbox)
+}
+
+// RollBack deletes the user created by the saga, with its sessions, and writes the compensating
+// outbox messages in one transaction
+func (s *RegistrationSaga) RollBack(outbox ...OutboxMessage) error {
+	return s.finish(SagaRolledBack, func(ctx context.Context, tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, s.UserID)
+		return err
+	}, outbox)
+}
+
+// finish moves the saga to a final state
+func (s *RegistrationSaga) finish(state string, step func(ctx context.Context, tx pgx.Tx) error, outbox []OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	if step != nil {
+		if err := step(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM pending_registrations WHERE key_uid = $1`, s.PendingKeyUID); err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(
+		ctx,
+		`UPDATE registration_sagas SET state = $2, updated_at = CURRENT_TIMESTAMP
+         WHERE id = $1 AND state NOT IN ('completed', 'rolled_back')
+         RETURNING updated_at`,
+		s.ID, state,
+	).Scan(&s.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrRegistrationSagaNotFound
+		}
+		return err
+	}
+
+	if err := insertOutbox(ctx, tx, outbox); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	s.State = state
+	return nil
+}
+
+// GetStuckRegistrationSagas lists the unfinished sagas that have not moved since the given time
+func GetStuckRegistrationSagas(before time.Time, limit int) ([]RegistrationSaga, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	rows, err := DB.Query(
+		ctx,
+		`SELECT id, user_id, pending_key_uid, state, wallet_id, session_id, attempts, last_error, created_at, updated_at
+         FROM registration_sagas
+         WHERE state NOT IN ('completed', 'rolled_back') AND updated_at < $1
+         ORDER BY updated_at
+         LIMIT $2`,
+		before, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (RegistrationSaga, error) {
+		var s RegistrationSaga
+		err := row.Scan(
+			&s.ID, &s.UserID, &s.PendingKeyUID, &s.State, &s.WalletID, &s.SessionID, &s.Attempts, &s.LastError,
+			&s.CreatedAt, &s.UpdatedAt,
+		)
+		return s, err
+	})
+}
+
+// WithRegistrationReconcilerLock runs fn while holding the reconciler advisory lock.
+// It returns false without running fn when another replica holds the lock.
+func WithRegistrationReconcilerLock(fn func()) (bool, error) {
+	ctx := context.Background()
+	conn, err := DB.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, registrationReconcilerLockID).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	defer func() {
+		_, _ = conn.Exec(ctx, `SELECT pg_advisory_unlock($1)`, registrationReconcilerLockID)
+	}()
+
+	fn()
+	return true, nil
+}
@@ -0,0 +1,164 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a server-side login session. Its ID is carried in the access token
+// and doubles as the family ID of the session's refresh tokens.
+type Session struct {
+	ID          uuid.UUID  `json:"id" db:"id,omitempty"`
+	UserID      uuid.UUID  `json:"user_id" db:"user_id"`
+	DeviceToken string     `json:"device_token" db:"device_token"`
+	IPAddress   string     `json:"ip_address" db:"ip_address"`
+	UserAgent   string     `json:"user_agent" db:"user_agent"`
+	ExpiresAt   time.Time  `json:"expires_at" db:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at" db:"revoked_at"`
+	LastSeenAt  time.Time  `json:"last_seen_at" db:"last_seen_at"`
+	Duress      bool       `json:"-" db:"duress"` // opened with the duress PIN
+	CreatedAt   time.Time  `json:"created_at" db:"created_at,omitempty"`
+}
+
+// SessionResponse is the struct returned when listing sessions
+type SessionResponse struct {
+	ID         uuid.UUID `json:"id"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CreateSession stores a new session
+func (s *Session) CreateSession() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	return DB.QueryRow(
+		ctx,
+		`INSERT INTO sessions (user_id, device_token, ip_address, user_agent, expires_at, duress)
+         VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, last_seen_at, created_at`,
+		s.UserID, s.DeviceToken, s.IPAddress, s.UserAgent, s.ExpiresAt, s.Duress,
+	).Scan(&s.ID, &s.LastSeenAt, &s.CreatedAt)
+}
+
+// GetSession finds a session by ID
+func GetSession(id uuid.UUID) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var s Session
+	err := DB.QueryRow(
+		ctx,
+		`SELECT id, user_id, device_token, ip_address, user_agent, expires_at, revoked_at, last_seen_at, duress, created_at
+         FROM sessions WHERE id = $1`,
+		id,
+	).Scan(
+		&s.ID, &s.UserID, &s.DeviceToken, &s.IPAddress, &s.UserAgent, &s.ExpiresAt, &s.RevokedAt, &s.LastSeenAt,
+		&s.Duress, &s.CreatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetActiveSessions lists the sessions of a user that are neither revoked nor expired
+func GetActiveSessions(userID uuid.UUID) ([]Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	rows, err := DB.Query(
+		ctx,
+		`SELECT id, user_id, device_token, ip_address, user_agent, expires_at, revoked_at, last_seen_at, created_at
+         FROM sessions WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+         ORDER BY last_seen_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(
+			&s.ID, &s.UserID, &s.DeviceToken, &s.IPAddress, &s.UserAgent, &s.ExpiresAt, &s.RevokedAt, &s.LastSeenAt,
+			&s.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession records activity on a session
+func TouchSession(id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err := DB.Exec(ctx, `UPDATE sessions SET last_seen_at = CURRENT_TIMESTAMP WHERE id = $1`, id)
+	return err
+}
+
+// RevokeSession revokes a session and its refresh tokens
+func RevokeSession(id uuid.UUID) error {
+	ctx := context.Background()
+	_, err := WithTransaction(
+		DB, func(tx pgx.Tx) (any, error) {
+			_, err := tx.Exec(
+				ctx, `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL`, id,
+			)
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.Exec(
+				ctx,
+				`UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE family_id = $1 AND revoked_at IS NULL`,
+				id,
+			)
+			return nil, err
+		},
+	)
+	return err
+}
+
+// RevokeUserSessions revokes every session of a user and their refresh tokens, returning the revoked IDs
+func RevokeUserSessions(userID uuid.UUID) ([]uuid.UUID, error) {
+	ctx := context.Background()
+	return WithTransaction(
+		DB, func(tx pgx.Tx) ([]uuid.UUID, error) {
+			rows, err := tx.Query(
+				ctx,
+				`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+                 WHERE user_id = $1 AND revoked_at IS NULL RETURNING id`,
+				userID,
+			)
+			if err != nil {
+				return nil, err
+			}
+			ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.Exec(
+				ctx,
+				`UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL`,
+				userID,
+			)
+			return ids, err
+		},
+	)
+}
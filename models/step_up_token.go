@@ -0,0 +1,63 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrStepUpTokenNotFound = errors.New("step-up token not found")
+
+// StepUpToken records a step-up token issued by auth.pin.verify. The token only carries its ID,
+// so that whether it was issued for the duress PIN is only told by introspection, which uses it up.
+type StepUpToken struct {
+	ID        uuid.UUID  `json:"id" db:"id"`
+	UserID    uuid.UUID  `json:"user_id" db:"user_id"`
+	Audience  string     `json:"audience" db:"audience"`
+	Duress    bool       `json:"-" db:"duress"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt    *time.Time `json:"used_at" db:"used_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at,omitempty"`
+}
+
+// CreateStepUpToken stores a step-up token and drops the expired ones of the user
+func (t *StepUpToken) CreateStepUpToken() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	return DB.QueryRow(
+		ctx,
+		`WITH expired AS (
+             DELETE FROM step_up_tokens WHERE user_id = $2 AND expires_at < CURRENT_TIMESTAMP
+         )
+         INSERT INTO step_up_tokens (id, user_id, audience, duress, expires_at)
+         VALUES ($1, $2, $3, $4, $5) RETURNING created_at`,
+		t.ID, t.UserID, t.Audience, t.Duress, t.ExpiresAt,
+	).Scan(&t.CreatedAt)
+}
+
+// UseStepUpToken marks an unexpired step-up token issued to the user for the audience as used, and returns it.
+// A token can only be used once, so ErrStepUpTokenNotFound is returned when it was used before.
+func UseStepUpToken(id, userID uuid.UUID, audience string) (*StepUpToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var t StepUpToken
+	err := DB.QueryRow(
+		ctx,
+		`UPDATE step_up_tokens SET used_at = CURRENT_TIMESTAMP
+         WHERE id = $1 AND user_id = $2 AND audience = $3 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+         RETURNING id, user_id, audience, duress, expires_at, used_at, created_at`,
+		id, userID, audience,
+	).Scan(&t.ID, &t.UserID, &t.Audience, &t.Duress, &t.ExpiresAt, &t.UsedAt, &t.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrStepUpTokenNotFound
+		}
+		return nil, err
+	}
+	return &t, nil
+}
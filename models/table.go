@@ -17,7 +17,7 @@ func createTables() error {
 			last_name VARCHAR(100) NOT NULL,
 			phone_number VARCHAR(18) UNIQUE NOT NULL,
 			device_token Text NOT NULL,
-			pin VARCHAR(100) NOT NULL,
+			pin VARCHAR(255) NOT NULL,
 			quota BIGINT DEFAULT 0 NOT NULL,
 			locked BOOLEAN DEFAULT FALSE NOT NULL,
 			premium BOOLEAN DEFAULT FALSE NOT NULL,
@@ -38,8 +38,135 @@ func createTables() error {
 				REFERENCES users (id)
 				ON DELETE CASCADE
 		);`,
+		`CREATE TABLE IF NOT EXISTS otp_codes (
+			key_uid UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			phone_number VARCHAR(18) NOT NULL,
+			purpose VARCHAR(50) NOT NULL, -- 'reset_pin', etc.
+			code_hash VARCHAR(100) NOT NULL,
+			attempts INT DEFAULT 0 NOT NULL,
+			max_attempts INT DEFAULT 3 NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS pending_registrations (
+			key_uid UUID PRIMARY KEY,
+			first_name VARCHAR(100) NOT NULL,
+			last_name VARCHAR(100) NOT NULL,
+			phone_number VARCHAR(18) NOT NULL,
+			device_token Text NOT NULL,
+			pin VARCHAR(255) NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL,
+			device_token Text NOT NULL,
+			ip_address VARCHAR(45) NOT NULL,
+			user_agent Text NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			revoked_at TIMESTAMPTZ,
+			last_seen_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT fk_session_user FOREIGN KEY (user_id)
+				REFERENCES users (id)
+				ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL,
+			family_id UUID NOT NULL,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ,
+			revoked_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT fk_refresh_token_user FOREIGN KEY (user_id)
+				REFERENCES users (id)
+				ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS outbox (
+			id UUID PRIMARY KEY,
+			kind VARCHAR(20) NOT NULL, -- 'event' or 'command'
+			subject VARCHAR(100) NOT NULL,
+			payload BYTEA NOT NULL,
+			attempts INT DEFAULT 0 NOT NULL,
+			next_attempt_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+			last_error Text,
+			delivered_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS registration_sagas (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL, -- no foreign key, the user is deleted on rollback
+			pending_key_uid UUID NOT NULL,
+			state VARCHAR(30) NOT NULL, -- 'user_created', 'wallet_requested', ..., 'completed', 'rolled_back'
+			wallet_id UUID,
+			session_id UUID,
+			attempts INT DEFAULT 0 NOT NULL,
+			last_error Text,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS pin_history (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL,
+			pin_hash VARCHAR(255) NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT clock_timestamp(),
+			CONSTRAINT fk_pin_history_user FOREIGN KEY (user_id)
+				REFERENCES users (id)
+				ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS login_failures (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL,
+			ip_address VARCHAR(45) NOT NULL,
+			source VARCHAR(50) NOT NULL, -- 'login', 'pin_verify', etc.
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT fk_login_failure_user FOREIGN KEY (user_id)
+				REFERENCES users (id)
+				ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS step_up_tokens (
+			id UUID PRIMARY KEY, -- jti of the token
+			user_id UUID NOT NULL,
+			audience VARCHAR(100) NOT NULL,
+			duress BOOLEAN DEFAULT FALSE NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT fk_step_up_token_user FOREIGN KEY (user_id)
+				REFERENCES users (id)
+				ON DELETE CASCADE
+		);`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS lock_count INT DEFAULT 0 NOT NULL;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS last_failed_at TIMESTAMPTZ;`,
+		`ALTER TABLE users_logs ALTER COLUMN user_id DROP NOT NULL;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS pin_length SMALLINT DEFAULT 4 NOT NULL;`,
+		`ALTER TABLE pending_registrations ADD COLUMN IF NOT EXISTS pin_length SMALLINT DEFAULT 4 NOT NULL;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS duress_pin VARCHAR(255);`,
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS duress BOOLEAN DEFAULT FALSE NOT NULL;`,
+		// Peppered Argon2id PHC strings are longer than the 100 characters PIN hashes had
+		`ALTER TABLE users ALTER COLUMN pin TYPE VARCHAR(255);`,
+		`ALTER TABLE users ALTER COLUMN duress_pin TYPE VARCHAR(255);`,
+		`ALTER TABLE pending_registrations ALTER COLUMN pin TYPE VARCHAR(255);`,
+		`ALTER TABLE pin_history ALTER COLUMN pin_hash TYPE VARCHAR(255);`,
+		`ALTER TABLE step_up_tokens ADD COLUMN IF NOT EXISTS used_at TIMESTAMPTZ;`,
+		`ALTER TABLE users_logs ADD COLUMN IF NOT EXISTS internal BOOLEAN DEFAULT FALSE NOT NULL;`, // never shown to the user
 		`CREATE INDEX IF NOT EXISTS idx_users_lookup ON users (phone_number, is_active, quota, locked, premium);`,
 		`CREATE INDEX IF NOT EXISTS idx_users_logs_created_at ON users_logs(created_at, user_id, phone_number);`,
+		`CREATE INDEX IF NOT EXISTS idx_otp_codes_phone ON otp_codes(phone_number, purpose, used_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_pending_registrations_phone ON pending_registrations(phone_number, created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id, revoked_at, expires_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family_id, revoked_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_login_failures_user ON login_failures(user_id, created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_pin_history_user ON pin_history(user_id, created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_users_locked_until ON users(locked_until) WHERE locked = true;`,
+		`CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(next_attempt_at) WHERE delivered_at IS NULL;`,
+		`CREATE INDEX IF NOT EXISTS idx_step_up_tokens_user ON step_up_tokens(user_id, expires_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_registration_sagas_pending ON registration_sagas(updated_at)
+			WHERE state NOT IN ('completed', 'rolled_back');`,
 	}
 	for _, query := range queries {
 		if _, err := DB.Exec(ctx, query); err != nil {
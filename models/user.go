@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"github.com/google/uuid"
 	"time"
 
@@ -12,40 +11,55 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	ErrUserNotFound = errors.New("user not found")
+	// ErrPinNotUpdated is returned when the account became locked or inactive before its PIN was replaced
+	ErrPinNotUpdated = errors.New("pin not updated")
+	// ErrAttemptThrottled is returned when a PIN attempt comes before the delay imposed by the previous failures
+	ErrAttemptThrottled = errors.New("attempt before the failure delay")
+)
+
 // UserLogin is the struct for user login
 type UserLogin struct {
 	PhoneNumber string `json:"phone_number" binding:"required,e164"`
-	Pin         string `json:"pin" binding:"required,len=4,numeric"`
+	Pin         string `json:"pin" binding:"required,numeric"`
 	DeviceToken string `json:"device_token" binding:"required"`
+	CodeOTP     string `json:"code_otp" binding:"omitempty,len=5,numeric"`
+	KeyUID      string `json:"key_uid" binding:"omitempty,uuid"`
 }
 
 // User is the struct for a user
 type User struct {
-	ID          uuid.UUID `json:"id" db:"id,omitempty"`
-	FirstName   string    `json:"first_name" db:"first_name" binding:"required,alpha,min=3,max=100"`
-	LastName    string    `json:"last_name" db:"last_name" binding:"required,alpha,min=3,max=100"`
-	PhoneNumber string    `json:"phone_number" db:"phone_number" binding:"required,e164"`
-	DeviceToken string    `json:"device_token" db:"device_token" binding:"required"`
-	Pin         string    `json:"pin" db:"pin" binding:"required,len=4,numeric"`
-	Quota       uint      `json:"quota" db:"quota"`
-	Locked      bool      `json:"locked" db:"locked"`
-	Photo       string    `json:"photo" db:"photo,omitempty"`
-	IsActive    bool      `json:"is_active" db:"is_active"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at,omitempty"`
-	UpdatedAt   time.Time `json:"updated_at" db:"updated_at,omitempty"`
+	ID           uuid.UUID  `json:"id" db:"id,omitempty"`
+	FirstName    string     `json:"first_name" db:"first_name" binding:"required,alpha,min=3,max=100"`
+	LastName     string     `json:"last_name" db:"last_name" binding:"required,alpha,min=3,max=100"`
+	PhoneNumber  string     `json:"phone_number" db:"phone_number" binding:"required,e164"`
+	DeviceToken  string     `json:"device_token" db:"device_token" binding:"required"`
+	Pin          string     `json:"pin" db:"pin" binding:"required,numeric"`
+	PinLength    int        `json:"pin_length" db:"pin_length"`
+	DuressPin    *string    `json:"-" db:"duress_pin"` // hash of the optional PIN that signals coercion
+	Quota        uint       `json:"quota" db:"quota"`  // consecutive failed PIN attempts
+	Locked       bool       `json:"locked" db:"locked"`
+	LockedUntil  *time.Time `json:"locked_until" db:"locked_until"` // nil with Locked is a permanent lock
+	LockCount    int        `json:"lock_count" db:"lock_count"`
+	LastFailedAt *time.Time `json:"last_failed_at" db:"last_failed_at"`
+	Photo        string     `json:"photo" db:"photo,omitempty"`
+	IsActive     bool       `json:"is_active" db:"is_active"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at,omitempty"`
+	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at,omitempty"`
 }
 
 // Login is the struct for login
 type Login struct {
 	PhoneNumber string `json:"phone_number" binding:"required,e164"`
-	Pin         string `json:"pin" binding:"required,len=4,numeric"`
+	Pin         string `json:"pin" binding:"required,numeric"`
 	DeviceToken string `json:"device_token" binding:"required"`
 }
 
 // ResetPin is the struct for resetting the pin
 type ResetPin struct {
 	PhoneNumber string `json:"phone_number" binding:"required,e164"`
-	Pin         string `json:"pin" binding:"required,len=4,numeric"`
+	Pin         string `json:"pin" binding:"required,numeric"`
 	CodeOTP     string `json:"code_otp" binding:"required,len=5,numeric"`
 	KeyUID      string `json:"key_uid" binding:"required,uuid"`
 }
@@ -53,26 +67,53 @@ type ResetPin struct {
 // UpdatePin is the struct for updating the pin
 type UpdatePin struct {
 	PhoneNumber string `json:"phone_number" binding:"required"`
-	OldPin      string `json:"old_pin" binding:"required,len=4,numeric"`
-	NewPin      string `json:"new_pin" binding:"required,len=4,numeric"`
-	ConfirmPin  string `json:"confirm_pin" binding:"required,len=4,numeric,eqfield=NewPin"`
+	OldPin      string `json:"old_pin" binding:"required,numeric"`
+	NewPin      string `json:"new_pin" binding:"required,numeric"`
+	ConfirmPin  string `json:"confirm_pin" binding:"required,numeric,eqfield=NewPin"`
+}
+
+// SetDuressPin is the struct for setting the duress PIN
+type SetDuressPin struct {
+	Pin              string `json:"pin" binding:"required,numeric"`
+	DuressPin        string `json:"duress_pin" binding:"required,numeric"`
+	ConfirmDuressPin string `json:"confirm_duress_pin" binding:"required,numeric,eqfield=DuressPin"`
+}
+
+// RemoveDuressPin is the struct for removing the duress PIN
+type RemoveDuressPin struct {
+	Pin string `json:"pin" binding:"required,numeric"`
 }
 
 // RemoveUserAccount is the struct to remove a user
 type RemoveUserAccount struct {
 	PhoneNumber string `json:"phone_number" binding:"required,e164,min=11,max=14"`
-	Pin         string `json:"pin" binding:"required,len=4,numeric"`
+	Pin         string `json:"pin" binding:"required,numeric"`
 }
 
+// Wallet statuses. An unavailable wallet only carries its status, the client fetches the balance later.
+const (
+	WalletAvailable   = "available"
+	WalletUnavailable = "unavailable"
+)
+
 type Wallet struct {
-	ID       uuid.UUID `json:"id"`
+	ID       uuid.UUID `json:"id,omitzero"`
 	Balance  float64   `json:"balance"`
-	Currency string    `json:"currency"`
+	Currency string    `json:"currency,omitempty"`
+	Status   string    `json:"status"`
 }
 
 type AuthResponse struct {
-	User   UserResponse `json:"user"`
-	Wallet Wallet       `json:"wallet"`
+	User         UserResponse `json:"user"`
+	Wallet       *Wallet      `json:"wallet,omitempty"`
+	RefreshToken string       `json:"refresh_token,omitempty"`
+	PinUpgrade   *PinUpgrade  `json:"pin_upgrade,omitempty"`
+}
+
+// PinUpgrade tells a user signed in with a PIN of the previous length to choose a new one
+type PinUpgrade struct {
+	Required bool `json:"required"`
+	Length   int  `json:"length"`
 }
 
 type UserResponse struct {
@@ -91,11 +132,12 @@ type AuthLog struct {
 	Activity    string    `json:"activity" db:"activity"`
 	PhoneNumber string    `json:"phone_number" db:"phone_number"`
 	Metadata    string    `json:"metadata" db:"metadata"`
+	Internal    bool      `json:"-" db:"internal"` // kept out of the history shown to the user
 	CreatedAt   time.Time `json:"created_at" db:"created_at,omitempty"`
 }
 
-// UpdateUserPin updates the pin of a user
-func (user *User) UpdateUserPin() error {
+// UpdateUserPin updates the pin of a user, keeps the previous one in the PIN history and writes the outbox messages in the same transaction
+func (user *User) UpdateUserPin(outbox ...OutboxMessage) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
@@ -107,14 +149,27 @@ func (user *User) UpdateUserPin() error {
 		_ = tx.Rollback(ctx)
 	}()
 
-	_, err = tx.Exec(
+	if err := savePinHistory(ctx, tx, user.PhoneNumber); err != nil {
+		return err
+	}
+
+	tag, err := tx.Exec(
 		ctx,
-		`UPDATE users SET pin = $1 WHERE phone_number = $2 AND is_active = true AND locked = false AND quota = 0`,
-		user.Pin, user.PhoneNumber,
+		`UPDATE users SET pin = $1, pin_length = $2
+         WHERE phone_number = $3 AND is_active = true AND locked = false AND quota = 0`,
+		user.Pin, user.PinLength, user.PhoneNumber,
 	)
 	if err != nil {
 		return err
 	}
+	// Roll back the PIN history too when the account changed since it was read
+	if tag.RowsAffected() == 0 {
+		return ErrPinNotUpdated
+	}
+
+	if err := insertOutbox(ctx, tx, outbox); err != nil {
+		return err
+	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return err
@@ -123,66 +178,299 @@ func (user *User) UpdateUserPin() error {
 	return nil
 }
 
-// UpdateUserQuota updates the user data
-func (user *User) UpdateUserQuota() error {
+// ResetUserPin replaces the pin of a user, keeps the previous one in the PIN history and clears the login quota and lock,
+// writing the outbox messages in the same transaction. The unlock messages are only written when the account was locked.
+// It reports whether it was.
+func (user *User) ResetUserPin(unlock []OutboxMessage, outbox ...OutboxMessage) (bool, error) {
 	ctx := context.Background()
-	_, err := WithTransaction(
-		DB, func(tx pgx.Tx) (any, error) {
-			_, err := tx.Exec(
-				ctx, `UPDATE users SET quota = quota + 1 WHERE phone_number = $1 AND is_active = true 
-                AND locked = false AND quota < 3`, user.PhoneNumber,
+	return WithTransaction(
+		DB, func(tx pgx.Tx) (bool, error) {
+			var locked bool
+			err := tx.QueryRow(
+				ctx,
+				`SELECT locked FROM users WHERE phone_number = $1 AND is_active = true FOR UPDATE`,
+				user.PhoneNumber,
+			).Scan(&locked)
+			if err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					return false, ErrPinNotUpdated
+				}
+				return false, err
+			}
+			if err := savePinHistory(ctx, tx, user.PhoneNumber); err != nil {
+				return false, err
+			}
+			_, err = tx.Exec(
+				ctx,
+				`UPDATE users SET pin = $1, pin_length = $2, quota = 0, locked = false, locked_until = NULL,
+                lock_count = 0, last_failed_at = NULL, updated_at = CURRENT_TIMESTAMP
+                WHERE phone_number = $3 AND is_active = true`,
+				user.Pin, user.PinLength, user.PhoneNumber,
 			)
-			return nil, err
+			if err != nil {
+				return false, err
+			}
+			if err := insertOutbox(ctx, tx, outbox); err != nil {
+				return false, err
+			}
+			if !locked {
+				return false, nil
+			}
+			return true, insertOutbox(ctx, tx, unlock)
 		},
 	)
-	if err != nil {
-		return err
+}
+
+// LockRule tells RecordFailedAttempt when and how long to lock an account
+type LockRule struct {
+	MaxAttempts int
+	// LockUntil returns the end of the lock given the number of previous locks, nil for a permanent lock
+	LockUntil func(previousLocks int) *time.Time
+	// Outbox returns the messages to write when the account gets locked
+	Outbox func(user *User) ([]OutboxMessage, error)
+	// Delay returns how long to wait after the last failure given the number of failures
+	Delay func(failures uint) time.Duration
+}
+
+// throttled reports whether an attempt made at now comes before the delay imposed by the user's failures
+func (rule LockRule) throttled(user *User, now time.Time) bool {
+	if rule.Delay == nil || user.LastFailedAt == nil {
+		return false
 	}
-	return nil
+	return now.Before(user.LastFailedAt.Add(rule.Delay(user.Quota)))
 }
 
-// LockUser locks a user account
-func (user *User) LockUser() error {
+// RecordFailedAttempt atomically records a failed PIN attempt and locks the account once the rule says so.
+// The user row is locked for the whole transaction, so concurrent attempts are counted one after the other
+// and exactly one of them locks the account. Attempts made while the account is locked are not counted.
+// Attempts made before the delay of the rule are not counted either and return ErrAttemptThrottled,
+// so that parallel requests checked against the same earlier read cannot skip the delay.
+// It returns whether this attempt locked the account; the user fields are refreshed either way.
+func (user *User) RecordFailedAttempt(ipAddress, source string, rule LockRule) (bool, error) {
 	ctx := context.Background()
-	_, err := WithTransaction(
-		DB, func(tx pgx.Tx) (any, error) {
-			_, err := tx.Exec(
-				ctx, "UPDATE users SET locked = $1 WHERE id = $2 AND is_active = true AND quota >= 3",
-				true, user.ID,
-			)
-			return nil, err
+	return WithTransaction(
+		DB, func(tx pgx.Tx) (bool, error) {
+			var now time.Time
+			err := tx.QueryRow(
+				ctx,
+				`SELECT quota, locked, locked_until, lock_count, last_failed_at, CURRENT_TIMESTAMP FROM users
+                WHERE id = $1 AND is_active = true FOR UPDATE`,
+				user.ID,
+			).Scan(&user.Quota, &user.Locked, &user.LockedUntil, &user.LockCount, &user.LastFailedAt, &now)
+			if err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					return false, ErrUserNotFound
+				}
+				return false, err
+			}
+			if user.IsLocked() {
+				return false, nil
+			}
+			if rule.throttled(user, now) {
+				return false, ErrAttemptThrottled
+			}
+
+			if _, err := tx.Exec(
+				ctx,
+				`INSERT INTO login_failures (user_id, ip_address, source) VALUES ($1, $2, $3)`,
+				user.ID, ipAddress, source,
+			); err != nil {
+				return false, err
+			}
+
+			user.Quota++
+			locking := int(user.Quota) >= rule.MaxAttempts
+			if locking {
+				user.LockedUntil = rule.LockUntil(user.LockCount)
+				user.Locked = true
+				user.LockCount++
+			}
+
+			err = tx.QueryRow(
+				ctx,
+				`UPDATE users SET quota = $2, last_failed_at = CURRENT_TIMESTAMP,
+                locked = $3, locked_until = $4, lock_count = $5
+                WHERE id = $1
+                RETURNING last_failed_at`,
+				user.ID, user.Quota, user.Locked, user.LockedUntil, user.LockCount,
+			).Scan(&user.LastFailedAt)
+			if err != nil || !locking {
+				return false, err
+			}
+
+			if rule.Outbox != nil {
+				outbox, err := rule.Outbox(user)
+				if err != nil {
+					return false, err
+				}
+				if err := insertOutbox(ctx, tx, outbox); err != nil {
+					return false, err
+				}
+			}
+			return true, nil
 		},
 	)
+}
+
+// RecordSuccessfulAttempt clears the failures after a right PIN. It returns false, without clearing anything,
+// when a concurrent attempt locked the account in the meantime, and ErrAttemptThrottled when the attempt came
+// before the delay of the rule, so that a right PIN among parallel attempts is not told apart from wrong ones.
+// The user fields are refreshed either way.
+func (user *User) RecordSuccessfulAttempt(rule LockRule) (bool, error) {
+	ctx := context.Background()
+	return WithTransaction(
+		DB, func(tx pgx.Tx) (bool, error) {
+			var now time.Time
+			err := tx.QueryRow(
+				ctx,
+				`SELECT quota, locked, locked_until, lock_count, last_failed_at, CURRENT_TIMESTAMP FROM users
+                WHERE id = $1 AND is_active = true FOR UPDATE`,
+				user.ID,
+			).Scan(&user.Quota, &user.Locked, &user.LockedUntil, &user.LockCount, &user.LastFailedAt, &now)
+			if err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					return false, nil
+				}
+				return false, err
+			}
+			if user.IsLocked() {
+				return false, nil
+			}
+			if rule.throttled(user, now) {
+				return false, ErrAttemptThrottled
+			}
+
+			if _, err := tx.Exec(
+				ctx,
+				`UPDATE users SET quota = 0, lock_count = 0, last_failed_at = NULL WHERE id = $1`,
+				user.ID,
+			); err != nil {
+				return false, err
+			}
+			user.Quota = 0
+			user.LockCount = 0
+			user.LastFailedAt = nil
+			return true, nil
+		},
+	)
+}
+
+// UpgradePinHash replaces the hash of the current PIN with a stronger one. Nothing is changed when the PIN
+// was changed since oldHash was read.
+func (user *User) UpgradePinHash(oldHash, newHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tag, err := DB.Exec(ctx, `UPDATE users SET pin = $1 WHERE id = $2 AND pin = $3`, newHash, user.ID, oldHash)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		user.Pin = newHash
+	}
+	return nil
+}
+
+// UpgradeDuressPinHash replaces the hash of the duress PIN with a stronger one. Nothing is changed when the
+// duress PIN was changed since oldHash was read.
+func (user *User) UpgradeDuressPinHash(oldHash, newHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tag, err := DB.Exec(ctx, `UPDATE users SET duress_pin = $1 WHERE id = $2 AND duress_pin = $3`, newHash, user.ID, oldHash)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() > 0 {
+		user.DuressPin = &newHash
+	}
 	return nil
 }
 
-// ResetUserQuota resets the user quota
-func (user *User) ResetUserQuota() error {
+// UnlockExpiredUser lifts a temporary lock that has expired and clears the consecutive failures.
+// It returns false when the user is not temporarily locked anymore, for example because another request
+// unlocked it first.
+func (user *User) UnlockExpiredUser(outbox ...OutboxMessage) (bool, error) {
+	ctx := context.Background()
+	return WithTransaction(
+		DB, func(tx pgx.Tx) (bool, error) {
+			tag, err := tx.Exec(
+				ctx,
+				`UPDATE users SET locked = false, locked_until = NULL, quota = 0
+                WHERE id = $1 AND locked = true AND locked_until <= CURRENT_TIMESTAMP`,
+				user.ID,
+			)
+			if err != nil || tag.RowsAffected() == 0 {
+				return false, err
+			}
+			user.Locked = false
+			user.LockedUntil = nil
+			user.Quota = 0
+			return true, insertOutbox(ctx, tx, outbox)
+		},
+	)
+}
+
+// UnlockUser lifts any lock and clears the failures, and writes the outbox messages in the same transaction
+func (user *User) UnlockUser(outbox ...OutboxMessage) error {
 	ctx := context.Background()
 	_, err := WithTransaction(
 		DB, func(tx pgx.Tx) (any, error) {
 			_, err := tx.Exec(
 				ctx,
-				"UPDATE users SET quota = $1 WHERE phone_number = $2 AND is_active = true",
-				0, user.PhoneNumber,
+				`UPDATE users SET locked = false, locked_until = NULL, quota = 0, lock_count = 0, last_failed_at = NULL
+                WHERE id = $1 AND is_active = true`,
+				user.ID,
 			)
-			return nil, err
+			if err != nil {
+				return nil, err
+			}
+			return nil, insertOutbox(ctx, tx, outbox)
 		},
 	)
 	if err != nil {
 		return err
 	}
+	user.Locked = false
+	user.LockedUntil = nil
+	user.Quota = 0
+	user.LockCount = 0
+	user.LastFailedAt = nil
 	return nil
 }
 
-// CreateUser creates a new user
-func (user *User) CreateUser() (*User, error) {
+// GetExpiredLockedUsers lists the users whose temporary lock has expired
+func GetExpiredLockedUsers(limit int) ([]User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	rows, err := DB.Query(
+		ctx,
+		`SELECT id, phone_number FROM users
+         WHERE locked = true AND locked_until <= CURRENT_TIMESTAMP AND is_active = true
+         LIMIT $1`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (User, error) {
+		var user User
+		err := row.Scan(&user.ID, &user.PhoneNumber)
+		return user, err
+	})
+}
+
+// IsLocked reports whether the account is locked now. A temporary lock that has expired no longer counts.
+func (user *User) IsLocked() bool {
+	return user.Locked && (user.LockedUntil == nil || time.Now().Before(*user.LockedUntil))
+}
+
+// CreateUser creates a new user and writes the outbox messages in the same transaction.
+// The ID is generated when it is not set, so that messages can reference it.
+func (user *User) CreateUser(outbox ...OutboxMessage) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	var photo sql.RawBytes
 
 	tx, err := DB.Begin(ctx)
 	if err != nil {
@@ -192,13 +480,36 @@ func (user *User) CreateUser() (*User, error) {
 		_ = tx.Rollback(ctx)
 	}()
 
+	newUser, err := user.insertUser(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := insertOutbox(ctx, tx, outbox); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return newUser, nil
+}
+
+// insertUser inserts the user in the caller's transaction
+func (user *User) insertUser(ctx context.Context, tx pgx.Tx) (*User, error) {
+	var photo sql.RawBytes
+	if user.ID == uuid.Nil {
+		user.ID = uuid.New()
+	}
+
 	var newUser User
-	err = tx.QueryRow(
+	err := tx.QueryRow(
 		ctx,
-		`INSERT INTO users(first_name, last_name, phone_number, pin, device_token)
-         VALUES ($1, $2, $3, $4, $5)
+		`INSERT INTO users(id, first_name, last_name, phone_number, pin, pin_length, device_token)
+         VALUES ($1, $2, $3, $4, $5, $6, $7)
          RETURNING id, first_name, last_name, phone_number, photo, device_token`,
-		user.FirstName, user.LastName, user.PhoneNumber, user.Pin, user.DeviceToken,
+		user.ID, user.FirstName, user.LastName, user.PhoneNumber, user.Pin, user.PinLength, user.DeviceToken,
 	).Scan(
 		&newUser.ID,
 		&newUser.FirstName,
@@ -210,11 +521,6 @@ func (user *User) CreateUser() (*User, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	if err := tx.Commit(ctx); err != nil {
-		return nil, err
-	}
-
 	return &newUser, nil
 }
 
@@ -241,8 +547,8 @@ func (user *User) RollbackUser() error {
 	return nil
 }
 
-// DeactivateUserAccount deactivate the user account
-func (user *User) DeactivateUserAccount() error {
+// DeactivateUserAccount deactivate the user account and writes the outbox messages in the same transaction
+func (user *User) DeactivateUserAccount(outbox ...OutboxMessage) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
@@ -260,6 +566,10 @@ func (user *User) DeactivateUserAccount() error {
 		return err
 	}
 
+	if err := insertOutbox(ctx, tx, outbox); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		return err
 	}
@@ -275,15 +585,15 @@ func GetUserByPhoneNumber(phone string) (*User, error) {
 	var photo sql.RawBytes
 	err := DB.QueryRow(
 		ctx,
-		`SELECT id, first_name, last_name, phone_number, pin, device_token, photo
+		`SELECT id, first_name, last_name, phone_number, pin, pin_length, duress_pin, device_token, photo
             FROM users WHERE phone_number = $1 AND is_active = $2`, phone, true,
 	).Scan(
-		&user.ID, &user.FirstName, &user.LastName, &user.PhoneNumber, &user.Pin, &user.DeviceToken,
-		&photo,
+		&user.ID, &user.FirstName, &user.LastName, &user.PhoneNumber, &user.Pin, &user.PinLength, &user.DuressPin,
+		&user.DeviceToken, &photo,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, pgx.ErrNoRows
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
@@ -295,7 +605,7 @@ func (user *User) CheckUserByPhone() bool {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	var id int
+	var id uuid.UUID
 	err := DB.QueryRow(
 		ctx,
 		`SELECT id FROM users WHERE phone_number = $1 AND is_active = true`,
@@ -319,22 +629,61 @@ func (user *User) GetUserByPhone() (*User, error) {
 	var photo sql.RawBytes
 	err := DB.QueryRow(
 		ctx,
-		`SELECT id, first_name, last_name, phone_number, device_token, pin, quota, locked, photo
+		`SELECT id, first_name, last_name, phone_number, device_token, pin, pin_length, duress_pin, quota, locked,
+                locked_until, lock_count, last_failed_at, photo
          FROM users WHERE phone_number = $1 AND is_active = true`,
 		user.PhoneNumber,
 	).Scan(
-		&user.ID, &user.FirstName, &user.LastName, &user.PhoneNumber, &user.DeviceToken, &user.Pin, &user.Quota,
-		&user.Locked, &photo,
+		&user.ID, &user.FirstName, &user.LastName, &user.PhoneNumber, &user.DeviceToken, &user.Pin, &user.PinLength,
+		&user.DuressPin, &user.Quota, &user.Locked, &user.LockedUntil, &user.LockCount, &user.LastFailedAt, &photo,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) || errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
 	return user, nil
 }
 
+// GetUserByID find an active user by ID
+func GetUserByID(id uuid.UUID) (*User, error) {
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var photo sql.RawBytes
+	err := DB.QueryRow(
+		ctx,
+		`SELECT id, first_name, last_name, phone_number, device_token, pin, pin_length, duress_pin, quota, locked,
+                locked_until, lock_count, last_failed_at, photo
+         FROM users WHERE id = $1 AND is_active = true`,
+		id,
+	).Scan(
+		&user.ID, &user.FirstName, &user.LastName, &user.PhoneNumber, &user.DeviceToken, &user.Pin, &user.PinLength,
+		&user.DuressPin, &user.Quota, &user.Locked, &user.LockedUntil, &user.LockCount, &user.LastFailedAt, &photo,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) || errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UpdateDuressPin sets the hash of the duress PIN, or removes the duress PIN when it is nil
+func (user *User) UpdateDuressPin() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err := DB.Exec(
+		ctx,
+		`UPDATE users SET duress_pin = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2 AND is_active = true`,
+		user.DuressPin, user.ID,
+	)
+	return err
+}
+
 // UpdateDeviceToken update user device token
 func (user *User) UpdateDeviceToken() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
@@ -373,15 +722,23 @@ func (l *AuthLog) CreateAuthLog() error {
 		_ = tx.Rollback(ctx) // no-op if already committed
 	}()
 
+	// Logs that are not tied to an account, such as credential stuffing detections, have no user
+	var userID any = l.UserID
+	if l.UserID == uuid.Nil {
+		userID = nil
+	}
+
 	// Create wallet log
 	_, err = tx.Exec(
 		ctx,
-		`INSERT INTO users_logs (user_id, phone_number, device_token, activity, metadata) VALUES ($1,$2,$3,$4,$5)`,
-		l.UserID,
+		`INSERT INTO users_logs (user_id, phone_number, device_token, activity, metadata, internal)
+         VALUES ($1,$2,$3,$4,$5,$6)`,
+		userID,
 		l.PhoneNumber,
 		l.DeviceToken,
 		l.Activity,
 		l.Metadata,
+		l.Internal,
 	)
 	if err != nil {
 		return err
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// kvMaxRetries bounds the compare-and-set attempts when replicas update the same bucket
+const kvMaxRetries = 5
+
+// ErrConflict is returned when a bucket keeps changing under a Take
+var ErrConflict = errors.New("rate limit bucket updated concurrently")
+
+// KVStore keeps buckets in a JetStream key-value bucket so that every replica shares the same limits.
+// Buckets are updated with compare-and-set on the entry revision.
+type KVStore struct {
+	kv jetstream.KeyValue
+}
+
+// NewKVStore returns a store backed by kv. The kv TTL should be at least the longest limit period.
+func NewKVStore(kv jetstream.KeyValue) *KVStore {
+	return &KVStore{kv: kv}
+}
+
+// Take takes a token from the bucket of key
+func (s *KVStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	kvKey := kvKey(key)
+
+	for range kvMaxRetries {
+		now := time.Now()
+
+		var state bucket
+		var revision uint64
+		entry, err := s.kv.Get(ctx, kvKey)
+		switch {
+		case errors.Is(err, jetstream.ErrKeyNotFound):
+			state = newBucket(limit, now)
+		case err != nil:
+			return Result{}, fmt.Errorf("unable to read rate limit bucket: %w", err)
+		default:
+			revision = entry.Revision()
+			if err := json.Unmarshal(entry.Value(), &state); err != nil {
+				state = newBucket(limit, now)
+			}
+		}
+
+		result := state.take(limit, now)
+		value, err := json.Marshal(state)
+		if err != nil {
+			return Result{}, err
+		}
+
+		if revision == 0 {
+			_, err = s.kv.Create(ctx, kvKey, value)
+		} else {
+			_, err = s.kv.Update(ctx, kvKey, value, revision)
+		}
+		if err == nil {
+			return result, nil
+		}
+		if !isRevisionConflict(err) {
+			return Result{}, fmt.Errorf("unable to write rate limit bucket: %w", err)
+		}
+	}
+	return Result{}, ErrConflict
+}
+
+// kvKey hashes a key since KV keys cannot hold characters such as ':' in IPv6 addresses
+func kvKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// isRevisionConflict reports whether a write failed because another replica updated the bucket first
+func isRevisionConflict(err error) bool {
+	var apiErr *jetstream.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence
+}
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const memoryPurgeInterval = time.Minute
+
+// MemoryStore keeps buckets in the process. Limits are not shared between replicas.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastPurge time.Time
+}
+
+type memoryBucket struct {
+	bucket
+	limit Limit
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*memoryBucket), lastPurge: time.Now()}
+}
+
+// Take takes a token from the bucket of key
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastPurge) >= memoryPurgeInterval {
+		s.purge(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok || b.limit != limit {
+		b = &memoryBucket{bucket: newBucket(limit, now), limit: limit}
+		s.buckets[key] = b
+	}
+	return b.take(limit, now), nil
+}
+
+// purge forgets the buckets that have refilled, since a new bucket is full anyway
+func (s *MemoryStore) purge(now time.Time) {
+	for key, b := range s.buckets {
+		if b.full(b.limit, now) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastPurge = now
+}
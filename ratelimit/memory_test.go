@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Burst: 2, Period: time.Hour}
+	ctx := context.Background()
+
+	for i, want := range []bool{true, true, false} {
+		result, err := store.Take(ctx, "a", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != want {
+			t.Fatalf("take %d on a: got allowed %t, want %t", i+1, result.Allowed, want)
+		}
+	}
+
+	// Buckets are kept by key
+	if result, _ := store.Take(ctx, "b", limit); !result.Allowed {
+		t.Error("expected the bucket of b to be full")
+	}
+
+	// A new limit for a key starts a new bucket
+	if result, _ := store.Take(ctx, "a", Limit{Burst: 3, Period: time.Hour}); !result.Allowed || result.Remaining != 2 {
+		t.Errorf("expected a new bucket after the limit changed, got %+v", result)
+	}
+}
+
+func TestMemoryStorePurge(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Burst: 2, Period: time.Minute}
+	ctx := context.Background()
+
+	_, _ = store.Take(ctx, "refilled", limit)
+	_, _ = store.Take(ctx, "recent", limit)
+	_, _ = store.Take(ctx, "disabled", Limit{})
+
+	// The first bucket was used two periods ago, the second one just now
+	store.mu.Lock()
+	store.buckets["refilled"].UpdatedAt = time.Now().Add(-2 * limit.Period)
+	store.lastPurge = time.Now().Add(-memoryPurgeInterval)
+	store.mu.Unlock()
+
+	_, _ = store.Take(ctx, "other", limit)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.buckets["refilled"]; ok {
+		t.Error("expected the refilled bucket to be purged")
+	}
+	if _, ok := store.buckets["disabled"]; ok {
+		t.Error("expected the bucket of a disabled limit to be purged")
+	}
+	if _, ok := store.buckets["recent"]; !ok {
+		t.Error("expected the recent bucket to be kept")
+	}
+	if _, ok := store.buckets["other"]; !ok {
+		t.Error("expected the new bucket to be kept")
+	}
+}
@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket that holds up to Burst tokens and refills Burst tokens every Period.
+// A zero limit is not enforced.
+type Limit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// Result is the outcome of taking a token from a bucket
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until a token is available, when not allowed
+}
+
+// Store keeps token buckets by key
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// ParseLimit parses a limit written as "<burst>/<period>", such as "20/1m". "0" disables the limit.
+func ParseLimit(value string) (Limit, error) {
+	value = strings.TrimSpace(value)
+	if value == "0" {
+		return Limit{}, nil
+	}
+	burst, period, found := strings.Cut(value, "/")
+	if !found {
+		return Limit{}, fmt.Errorf("invalid limit %q: expected <burst>/<period>", value)
+	}
+	n, err := strconv.Atoi(burst)
+	if err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q: bad burst", value)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q: bad period", value)
+	}
+	return Limit{Burst: n, Period: d}, nil
+}
+
+// Enabled reports whether the limit is enforced
+func (l Limit) Enabled() bool {
+	return l.Burst > 0 && l.Period > 0
+}
+
+// String formats the limit as ParseLimit reads it
+func (l Limit) String() string {
+	if !l.Enabled() {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Burst, l.Period)
+}
+
+// refill returns the tokens added per second
+func (l Limit) refill() float64 {
+	return float64(l.Burst) / l.Period.Seconds()
+}
+
+// bucket is the state of a token bucket. It is stored as JSON by the KV store.
+type bucket struct {
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// newBucket returns a full bucket
+func newBucket(limit Limit, now time.Time) bucket {
+	return bucket{Tokens: float64(limit.Burst), UpdatedAt: now}
+}
+
+// take refills the bucket up to now and takes one token if there is one. A disabled limit always allows.
+func (b *bucket) take(limit Limit, now time.Time) Result {
+	if !limit.Enabled() {
+		return Result{Allowed: true, Limit: limit.Burst}
+	}
+	if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(float64(limit.Burst), b.Tokens+elapsed*limit.refill())
+	}
+	b.UpdatedAt = now
+
+	result := Result{Limit: limit.Burst}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.Tokens) / limit.refill())
+	}
+	result.Remaining = int(b.Tokens)
+	result.Reset = seconds((float64(limit.Burst) - b.Tokens) / limit.refill())
+	return result
+}
+
+// full reports whether the bucket has refilled completely at now, so that it can be forgotten
+func (b *bucket) full(limit Limit, now time.Time) bool {
+	if !limit.Enabled() {
+		return true
+	}
+	return b.Tokens+now.Sub(b.UpdatedAt).Seconds()*limit.refill() >= float64(limit.Burst)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
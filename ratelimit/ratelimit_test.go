@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Limit
+		wantErr bool
+	}{
+		{"20/1m", Limit{Burst: 20, Period: time.Minute}, false},
+		{" 5/1h ", Limit{Burst: 5, Period: time.Hour}, false},
+		{"0/1m", Limit{Burst: 0, Period: time.Minute}, false},
+		{"0", Limit{}, false},
+		{"20", Limit{}, true},
+		{"x/1m", Limit{}, true},
+		{"-1/1m", Limit{}, true},
+		{"20/x", Limit{}, true},
+		{"20/0s", Limit{}, true},
+		{"20/-1m", Limit{}, true},
+		{"", Limit{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseLimit(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLimit(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLimit(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitString(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		want  string
+	}{
+		{Limit{Burst: 20, Period: time.Minute}, "20/1m0s"},
+		{Limit{}, "0"},
+		{Limit{Burst: 5}, "0"},
+		{Limit{Period: time.Minute}, "0"},
+	}
+	for _, tt := range tests {
+		if got := tt.limit.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.limit, got, tt.want)
+		}
+		if tt.limit.Enabled() {
+			parsed, err := ParseLimit(tt.limit.String())
+			if err != nil || parsed != tt.limit {
+				t.Errorf("ParseLimit(%q) = %+v, %v, want %+v", tt.limit.String(), parsed, err, tt.limit)
+			}
+		}
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	// 2 tokens, refilled at one every 30s
+	limit := Limit{Burst: 2, Period: time.Minute}
+	start := time.Now()
+	b := newBucket(limit, start)
+
+	steps := []struct {
+		name       string
+		at         time.Duration
+		allowed    bool
+		remaining  int
+		reset      time.Duration
+		retryAfter time.Duration
+	}{
+		{"first token", 0, true, 1, 30 * time.Second, 0},
+		{"last token", 0, true, 0, time.Minute, 0},
+		{"empty", 0, false, 0, time.Minute, 30 * time.Second},
+		{"partly refilled", 20 * time.Second, false, 0, 40 * time.Second, 10 * time.Second},
+		{"one token refilled", 30 * time.Second, true, 0, time.Minute, 0},
+		{"refilled up to the burst", 10 * time.Minute, true, 1, 30 * time.Second, 0},
+	}
+	for _, step := range steps {
+		result := b.take(limit, start.Add(step.at))
+		if result.Allowed != step.allowed || result.Remaining != step.remaining || result.Limit != limit.Burst {
+			t.Fatalf("%s: got allowed %t, remaining %d, limit %d, want %t, %d, %d", step.name,
+				result.Allowed, result.Remaining, result.Limit, step.allowed, step.remaining, limit.Burst)
+		}
+		if !near(result.Reset, step.reset) {
+			t.Errorf("%s: got reset %s, want %s", step.name, result.Reset, step.reset)
+		}
+		if !near(result.RetryAfter, step.retryAfter) {
+			t.Errorf("%s: got retry after %s, want %s", step.name, result.RetryAfter, step.retryAfter)
+		}
+	}
+}
+
+func TestBucketTakeDisabledLimit(t *testing.T) {
+	for _, limit := range []Limit{{}, {Burst: 5}, {Period: time.Minute}} {
+		b := newBucket(limit, time.Now())
+		for i := 0; i < 10; i++ {
+			if result := b.take(limit, time.Now()); !result.Allowed {
+				t.Fatalf("%+v: expected a disabled limit to allow every request", limit)
+			}
+		}
+		if !b.full(limit, time.Now()) {
+			t.Errorf("%+v: expected the bucket of a disabled limit to be full", limit)
+		}
+	}
+}
+
+// near reports whether two durations are within a millisecond, to absorb float rounding
+func near(a, b time.Duration) bool {
+	d := a - b
+	return d > -time.Millisecond && d < time.Millisecond
+}
@@ -0,0 +1,190 @@
+package walletclient
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned, as an ErrUnavailable error, while the breaker rejects calls
+var ErrCircuitOpen = errors.New("wallet circuit breaker open")
+
+// State is the state of a circuit breaker
+type State int
+
+const (
+	StateClosed   State = iota // calls go through
+	StateHalfOpen              // a single trial call goes through
+	StateOpen                  // calls fail right away
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateHalfOpen:
+		return "half_open"
+	default:
+		return "open"
+	}
+}
+
+// BreakerConfig configures a circuit breaker.
+// The breaker opens after Failures consecutive failures and tries again after Cooldown.
+type BreakerConfig struct {
+	Failures      int
+	Cooldown      time.Duration
+	OnStateChange func(state State)
+}
+
+// Breaker is a Client that stops calling the wallet service while it is failing.
+// Timeouts and unavailability count as failures; rejected requests and malformed replies do not,
+// since the service answered. Requests canceled by the caller are not counted either way.
+type Breaker struct {
+	client   Client
+	config   BreakerConfig
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// BreakerConfigFromEnv reads the breaker settings from WALLET_BREAKER_FAILURES and WALLET_BREAKER_COOLDOWN
+func BreakerConfigFromEnv() BreakerConfig {
+	config := BreakerConfig{Failures: defaultBreakerFailures, Cooldown: defaultBreakerCooldown}
+	if failures, err := strconv.Atoi(os.Getenv("WALLET_BREAKER_FAILURES")); err == nil && failures > 0 {
+		config.Failures = failures
+	}
+	if cooldown, err := time.ParseDuration(os.Getenv("WALLET_BREAKER_COOLDOWN")); err == nil && cooldown > 0 {
+		config.Cooldown = cooldown
+	}
+	return config
+}
+
+// NewBreaker wraps a client with a circuit breaker
+func NewBreaker(client Client, config BreakerConfig) *Breaker {
+	if config.Failures <= 0 {
+		config.Failures = defaultBreakerFailures
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = defaultBreakerCooldown
+	}
+	return &Breaker{client: client, config: config}
+}
+
+// State returns the current state of the breaker
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateOpen && time.Since(b.openedAt) >= b.config.Cooldown {
+		return StateHalfOpen
+	}
+	return b.state
+}
+
+// Create creates the wallet of a user
+func (b *Breaker) Create(ctx context.Context, userID uuid.UUID) (*models.Wallet, error) {
+	return call(b, "create", func() (*models.Wallet, error) { return b.client.Create(ctx, userID) })
+}
+
+// Balance returns the wallet of a user with its balance
+func (b *Breaker) Balance(ctx context.Context, userID uuid.UUID) (*models.Wallet, error) {
+	return call(b, "balance", func() (*models.Wallet, error) { return b.client.Balance(ctx, userID) })
+}
+
+// RestrictedBalance returns the wallet of a user with the restricted balance shown under duress
+func (b *Breaker) RestrictedBalance(ctx context.Context, userID uuid.UUID) (*models.Wallet, error) {
+	return call(b, "balance", func() (*models.Wallet, error) { return b.client.RestrictedBalance(ctx, userID) })
+}
+
+// Lock locks the wallet of a user
+func (b *Breaker) Lock(ctx context.Context, userID uuid.UUID) error {
+	_, err := call(b, "lock", func() (any, error) { return nil, b.client.Lock(ctx, userID) })
+	return err
+}
+
+// Unlock unlocks the wallet of a user
+func (b *Breaker) Unlock(ctx context.Context, userID uuid.UUID) error {
+	_, err := call(b, "unlock", func() (any, error) { return nil, b.client.Unlock(ctx, userID) })
+	return err
+}
+
+// call runs fn when the breaker allows it and records the outcome
+func call[T any](b *Breaker, op string, fn func() (T, error)) (T, error) {
+	var zero T
+	if !b.allow() {
+		return zero, &Error{Op: op, Kind: ErrUnavailable, Err: ErrCircuitOpen}
+	}
+	result, err := fn()
+	b.record(err)
+	return result, err
+}
+
+// allow reports whether a call may go through. After the cooldown, a single trial call is allowed.
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateClosed:
+		return true
+	case StateOpen:
+		if time.Since(b.openedAt) < b.config.Cooldown {
+			return false
+		}
+		b.setState(StateHalfOpen)
+		fallthrough
+	default:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of a call
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if errors.Is(err, ErrCanceled) {
+		// The caller gave up, which says nothing about the service
+		return
+	}
+	if err == nil || !(errors.Is(err, ErrTimeout) || errors.Is(err, ErrUnavailable)) {
+		b.failures = 0
+		b.setState(StateClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == StateHalfOpen || b.failures >= b.config.Failures {
+		b.openedAt = time.Now()
+		b.setState(StateOpen)
+	}
+}
+
+// setState changes the state and notifies the listener. It is called with the lock held.
+func (b *Breaker) setState(state State) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.config.OnStateChange != nil {
+		b.config.OnStateChange(state)
+	}
+}
@@ -0,0 +1,152 @@
+package walletclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	errTimeout  = &Error{Op: "balance", Kind: ErrTimeout, Err: context.DeadlineExceeded}
+	errRejected = &Error{Op: "balance", Kind: ErrRejected, Message: "wallet not found"}
+	errCanceled = &Error{Op: "balance", Kind: ErrCanceled, Err: context.Canceled}
+)
+
+// newTestBreaker returns a breaker over a fake that opens after 3 failures
+func newTestBreaker(states *[]State) (*Breaker, *Fake) {
+	fake := NewFake()
+	breaker := NewBreaker(fake, BreakerConfig{
+		Failures: 3,
+		Cooldown: time.Minute,
+		OnStateChange: func(state State) {
+			if states != nil {
+				*states = append(*states, state)
+			}
+		},
+	})
+	return breaker, fake
+}
+
+// failCalls makes n calls that fail with err
+func failCalls(t *testing.T, breaker *Breaker, fake *Fake, err error, n int) {
+	t.Helper()
+	fake.SetErr(err)
+	for i := 0; i < n; i++ {
+		_ = breaker.Lock(context.Background(), uuid.New())
+	}
+}
+
+// endCooldown moves the opening of the breaker back past the cooldown
+func endCooldown(breaker *Breaker) {
+	breaker.mu.Lock()
+	breaker.openedAt = time.Now().Add(-breaker.config.Cooldown)
+	breaker.mu.Unlock()
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	breaker, fake := newTestBreaker(nil)
+
+	failCalls(t, breaker, fake, errTimeout, 2)
+	if breaker.State() != StateClosed {
+		t.Fatalf("expected closed after 2 failures, got %s", breaker.State())
+	}
+	failCalls(t, breaker, fake, errTimeout, 1)
+	if breaker.State() != StateOpen {
+		t.Fatalf("expected open after 3 failures, got %s", breaker.State())
+	}
+
+	// Open: calls fail right away without reaching the service
+	calls := fake.CallCount()
+	fake.SetErr(nil)
+	_, err := breaker.Balance(context.Background(), uuid.New())
+	if !errors.Is(err, ErrCircuitOpen) || !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected an open circuit error, got %v", err)
+	}
+	if fake.CallCount() != calls {
+		t.Errorf("expected no call to the service while open")
+	}
+}
+
+func TestBreakerIgnoresAnsweredAndCanceledRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"rejected", errRejected},
+		{"malformed", &Error{Op: "balance", Kind: ErrMalformed}},
+		{"canceled", errCanceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker, fake := newTestBreaker(nil)
+			failCalls(t, breaker, fake, errTimeout, 2)
+			failCalls(t, breaker, fake, tt.err, 5)
+			if breaker.State() != StateClosed {
+				t.Errorf("expected closed, got %s", breaker.State())
+			}
+		})
+	}
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	breaker, fake := newTestBreaker(nil)
+	failCalls(t, breaker, fake, errTimeout, 2)
+	failCalls(t, breaker, fake, nil, 1)
+	failCalls(t, breaker, fake, errTimeout, 2)
+	if breaker.State() != StateClosed {
+		t.Errorf("expected closed, got %s", breaker.State())
+	}
+}
+
+func TestBreakerHalfOpenAllowsSingleTrial(t *testing.T) {
+	breaker, fake := newTestBreaker(nil)
+	failCalls(t, breaker, fake, errTimeout, 3)
+
+	endCooldown(breaker)
+	if breaker.State() != StateHalfOpen {
+		t.Fatalf("expected half open after the cooldown, got %s", breaker.State())
+	}
+	if !breaker.allow() {
+		t.Fatal("expected the trial call to go through")
+	}
+	if breaker.allow() {
+		t.Fatal("expected a second call to wait for the trial")
+	}
+
+	// A canceled trial frees the slot without deciding
+	breaker.record(errCanceled)
+	if breaker.State() != StateHalfOpen || !breaker.allow() {
+		t.Fatalf("expected another trial after a canceled one, got %s", breaker.State())
+	}
+	breaker.record(nil)
+	if breaker.State() != StateClosed {
+		t.Errorf("expected closed after a successful trial, got %s", breaker.State())
+	}
+}
+
+func TestBreakerReopensOnFailedTrial(t *testing.T) {
+	var states []State
+	breaker, fake := newTestBreaker(&states)
+	failCalls(t, breaker, fake, errTimeout, 3)
+
+	endCooldown(breaker)
+	failCalls(t, breaker, fake, errTimeout, 1)
+	if breaker.State() != StateOpen {
+		t.Fatalf("expected open after a failed trial, got %s", breaker.State())
+	}
+
+	endCooldown(breaker)
+	failCalls(t, breaker, fake, nil, 1)
+	want := []State{StateOpen, StateHalfOpen, StateOpen, StateHalfOpen, StateClosed}
+	if len(states) != len(want) {
+		t.Fatalf("expected transitions %v, got %v", want, states)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("expected transitions %v, got %v", want, states)
+		}
+	}
+}
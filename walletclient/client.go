@@ -0,0 +1,220 @@
+// Package walletclient is the typed NATS client of the wallet service
+package walletclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/emmadal/feeti-module/subject"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultTimeout       = time.Second
+	defaultCreateTimeout = 3 * time.Second
+
+	// DuressHeader flags a balance request made for a session opened with the duress PIN
+	DuressHeader = "Feeti-Duress"
+)
+
+// Error kinds, matched with errors.Is
+var (
+	ErrTimeout     = errors.New("wallet service timeout")
+	ErrRejected    = errors.New("wallet service rejected the request")
+	ErrMalformed   = errors.New("malformed wallet service reply")
+	ErrUnavailable = errors.New("wallet service unavailable")
+	ErrCanceled    = errors.New("wallet request canceled")
+)
+
+// Client is the wallet service API used by the auth service
+type Client interface {
+	Create(ctx context.Context, userID uuid.UUID) (*models.Wallet, error)
+	Balance(ctx context.Context, userID uuid.UUID) (*models.Wallet, error)
+	RestrictedBalance(ctx context.Context, userID uuid.UUID) (*models.Wallet, error)
+	Lock(ctx context.Context, userID uuid.UUID) error
+	Unlock(ctx context.Context, userID uuid.UUID) error
+}
+
+// Config holds the request timeouts. Wallet creation gets its own, longer timeout.
+type Config struct {
+	Timeout       time.Duration
+	CreateTimeout time.Duration
+}
+
+// Error is returned by every client call. Kind is one of the error kinds above.
+type Error struct {
+	Op      string
+	Kind    error
+	Message string // reason given by the wallet service, for rejected requests
+	Err     error
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Message != "":
+		return fmt.Sprintf("wallet %s: %v: %s", e.Op, e.Kind, e.Message)
+	case e.Err != nil:
+		return fmt.Sprintf("wallet %s: %v: %v", e.Op, e.Kind, e.Err)
+	default:
+		return fmt.Sprintf("wallet %s: %v", e.Op, e.Kind)
+	}
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// UserRequest is the request of every wallet operation. It is sent as the bare user ID,
+// with the duress header when Duress is set.
+type UserRequest struct {
+	UserID uuid.UUID
+	Duress bool
+}
+
+// Reply is the envelope of a wallet service reply
+type Reply struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// walletData is the wallet in a reply. Fields are pointers to detect missing ones.
+type walletData struct {
+	ID       *uuid.UUID `json:"id"`
+	Balance  *float64   `json:"balance"`
+	Currency *string    `json:"currency"`
+}
+
+// ConfigFromEnv reads the timeouts from WALLET_TIMEOUT and WALLET_CREATE_TIMEOUT
+func ConfigFromEnv() Config {
+	config := Config{Timeout: defaultTimeout, CreateTimeout: defaultCreateTimeout}
+	if timeout, err := time.ParseDuration(os.Getenv("WALLET_TIMEOUT")); err == nil && timeout > 0 {
+		config.Timeout = timeout
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("WALLET_CREATE_TIMEOUT")); err == nil && timeout > 0 {
+		config.CreateTimeout = timeout
+	}
+	return config
+}
+
+type natsClient struct {
+	conn   *nats.Conn
+	config Config
+}
+
+// New returns a client sending requests on conn
+func New(conn *nats.Conn, config Config) Client {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.CreateTimeout <= 0 {
+		config.CreateTimeout = config.Timeout
+	}
+	return &natsClient{conn: conn, config: config}
+}
+
+// Create creates the wallet of a user
+func (c *natsClient) Create(ctx context.Context, userID uuid.UUID) (*models.Wallet, error) {
+	reply, err := c.request(ctx, "create", subject.SubjectWalletCreate, c.config.CreateTimeout, UserRequest{UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	return decodeWallet("create", reply)
+}
+
+// Balance returns the wallet of a user with its balance
+func (c *natsClient) Balance(ctx context.Context, userID uuid.UUID) (*models.Wallet, error) {
+	reply, err := c.request(ctx, "balance", subject.SubjectWalletBalance, c.config.Timeout, UserRequest{UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	return decodeWallet("balance", reply)
+}
+
+// RestrictedBalance returns the wallet of a user with the restricted balance shown under duress.
+// The request only differs from a balance request by its header, so the reply has the same shape.
+func (c *natsClient) RestrictedBalance(ctx context.Context, userID uuid.UUID) (*models.Wallet, error) {
+	reply, err := c.request(ctx, "balance", subject.SubjectWalletBalance, c.config.Timeout, UserRequest{UserID: userID, Duress: true})
+	if err != nil {
+		return nil, err
+	}
+	return decodeWallet("balance", reply)
+}
+
+// Lock locks the wallet of a user
+func (c *natsClient) Lock(ctx context.Context, userID uuid.UUID) error {
+	_, err := c.request(ctx, "lock", subject.SubjectWalletLock, c.config.Timeout, UserRequest{UserID: userID})
+	return err
+}
+
+// Unlock unlocks the wallet of a user
+func (c *natsClient) Unlock(ctx context.Context, userID uuid.UUID) error {
+	_, err := c.request(ctx, "unlock", subject.SubjectWalletUnlock, c.config.Timeout, UserRequest{UserID: userID})
+	return err
+}
+
+// request sends a request and classifies its failure
+func (c *natsClient) request(
+	ctx context.Context, op, subj string, timeout time.Duration, request UserRequest,
+) (*Reply, error) {
+	if c.conn == nil || c.conn.IsClosed() {
+		return nil, &Error{Op: op, Kind: ErrUnavailable}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	msg := nats.NewMsg(subj)
+	msg.Data = []byte(request.UserID.String())
+	if request.Duress {
+		msg.Header.Set(DuressHeader, "true")
+	}
+	reply, err := c.conn.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		return nil, classifyRequestError(op, err)
+	}
+
+	var decoded Reply
+	if err := json.Unmarshal(reply.Data, &decoded); err != nil {
+		return nil, &Error{Op: op, Kind: ErrMalformed, Err: err}
+	}
+	if !decoded.Success {
+		return nil, &Error{Op: op, Kind: ErrRejected, Message: decoded.Error}
+	}
+	return &decoded, nil
+}
+
+// classifyRequestError wraps the error of a request that got no reply in an Error of the matching kind
+func classifyRequestError(op string, err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return &Error{Op: op, Kind: ErrCanceled, Err: err}
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, nats.ErrTimeout):
+		return &Error{Op: op, Kind: ErrTimeout, Err: err}
+	default:
+		return &Error{Op: op, Kind: ErrUnavailable, Err: err}
+	}
+}
+
+// decodeWallet decodes the wallet of a successful reply and checks that every field is set
+func decodeWallet(op string, reply *Reply) (*models.Wallet, error) {
+	var data walletData
+	if err := json.Unmarshal(reply.Data, &data); err != nil {
+		return nil, &Error{Op: op, Kind: ErrMalformed, Err: err}
+	}
+	if data.ID == nil || *data.ID == uuid.Nil || data.Balance == nil || data.Currency == nil || *data.Currency == "" {
+		return nil, &Error{Op: op, Kind: ErrMalformed, Err: errors.New("missing wallet field")}
+	}
+	return &models.Wallet{
+		ID:       *data.ID,
+		Balance:  *data.Balance,
+		Currency: *data.Currency,
+		Status:   models.WalletAvailable,
+	}, nil
+}
@@ -0,0 +1,102 @@
+package walletclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+func TestDecodeWallet(t *testing.T) {
+	id := uuid.New()
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"complete", fmt.Sprintf(`{"id":%q,"balance":1500.5,"currency":"XOF"}`, id), false},
+		{"zero balance", fmt.Sprintf(`{"id":%q,"balance":0,"currency":"XOF"}`, id), false},
+		{"missing id", `{"balance":10,"currency":"XOF"}`, true},
+		{"nil id", fmt.Sprintf(`{"id":%q,"balance":10,"currency":"XOF"}`, uuid.Nil), true},
+		{"missing balance", fmt.Sprintf(`{"id":%q,"currency":"XOF"}`, id), true},
+		{"missing currency", fmt.Sprintf(`{"id":%q,"balance":10}`, id), true},
+		{"empty currency", fmt.Sprintf(`{"id":%q,"balance":10,"currency":""}`, id), true},
+		{"wrong type", fmt.Sprintf(`{"id":%q,"balance":"10","currency":"XOF"}`, id), true},
+		{"not an object", `[]`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wallet, err := decodeWallet("balance", &Reply{Success: true, Data: json.RawMessage(tt.data)})
+			if tt.wantErr {
+				if !errors.Is(err, ErrMalformed) {
+					t.Fatalf("expected a malformed error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wallet.ID != id || wallet.Currency != "XOF" || wallet.Status != models.WalletAvailable {
+				t.Errorf("unexpected wallet %+v", wallet)
+			}
+		})
+	}
+}
+
+func TestClassifyRequestError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind error
+	}{
+		{"canceled", context.Canceled, ErrCanceled},
+		{"deadline", context.DeadlineExceeded, ErrTimeout},
+		{"nats timeout", nats.ErrTimeout, ErrTimeout},
+		{"wrapped deadline", fmt.Errorf("request: %w", context.DeadlineExceeded), ErrTimeout},
+		{"no responders", nats.ErrNoResponders, ErrUnavailable},
+		{"connection closed", nats.ErrConnectionClosed, ErrUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyRequestError("create", tt.err)
+			if !errors.Is(err, tt.kind) {
+				t.Errorf("expected kind %v, got %v", tt.kind, err)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("expected the cause to be kept, got %v", err)
+			}
+			var walletErr *Error
+			if !errors.As(err, &walletErr) || walletErr.Op != "create" {
+				t.Errorf("expected an Error for create, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRequestWithoutConnection(t *testing.T) {
+	client := New(nil, Config{})
+	if _, err := client.Balance(context.Background(), uuid.New()); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected an unavailable error, got %v", err)
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	tests := []struct {
+		err  *Error
+		want string
+	}{
+		{&Error{Op: "lock", Kind: ErrRejected, Message: "wallet frozen"}, "wallet lock: wallet service rejected the request: wallet frozen"},
+		{&Error{Op: "balance", Kind: ErrTimeout, Err: nats.ErrTimeout}, "wallet balance: wallet service timeout: nats: timeout"},
+		{&Error{Op: "create", Kind: ErrUnavailable}, "wallet create: wallet service unavailable"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
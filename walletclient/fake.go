@@ -0,0 +1,111 @@
+package walletclient
+
+import (
+	"context"
+	"sync"
+
+	"github.com/emmadal/feeti-auth/models"
+	"github.com/google/uuid"
+)
+
+// Fake is an in-memory Client for tests. Err, when set, is returned by every call instead of its result.
+type Fake struct {
+	mu      sync.Mutex
+	Err     error
+	Wallets map[uuid.UUID]*models.Wallet
+	Locked  map[uuid.UUID]bool
+	Calls   []string
+}
+
+// NewFake returns a fake without wallets
+func NewFake() *Fake {
+	return &Fake{Wallets: make(map[uuid.UUID]*models.Wallet), Locked: make(map[uuid.UUID]bool)}
+}
+
+// SetErr sets the error returned by the next calls, nil to let them succeed
+func (f *Fake) SetErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Err = err
+}
+
+// CallCount returns the number of calls made to the fake
+func (f *Fake) CallCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.Calls)
+}
+
+// Create creates an empty wallet, or returns the existing one
+func (f *Fake) Create(ctx context.Context, userID uuid.UUID) (*models.Wallet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin("create"); err != nil {
+		return nil, err
+	}
+	wallet, ok := f.Wallets[userID]
+	if !ok {
+		wallet = &models.Wallet{ID: uuid.New(), Currency: "XOF", Status: models.WalletAvailable}
+		f.Wallets[userID] = wallet
+	}
+	copied := *wallet
+	return &copied, nil
+}
+
+// Balance returns the wallet of the user, or a rejection when there is none
+func (f *Fake) Balance(ctx context.Context, userID uuid.UUID) (*models.Wallet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin("balance"); err != nil {
+		return nil, err
+	}
+	wallet, ok := f.Wallets[userID]
+	if !ok {
+		return nil, &Error{Op: "balance", Kind: ErrRejected, Message: "wallet not found"}
+	}
+	copied := *wallet
+	return &copied, nil
+}
+
+// RestrictedBalance returns the wallet of the user like Balance, recorded as a restricted_balance call
+func (f *Fake) RestrictedBalance(ctx context.Context, userID uuid.UUID) (*models.Wallet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin("restricted_balance"); err != nil {
+		return nil, err
+	}
+	wallet, ok := f.Wallets[userID]
+	if !ok {
+		return nil, &Error{Op: "balance", Kind: ErrRejected, Message: "wallet not found"}
+	}
+	copied := *wallet
+	return &copied, nil
+}
+
+// Lock marks the wallet of the user locked
+func (f *Fake) Lock(ctx context.Context, userID uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin("lock"); err != nil {
+		return err
+	}
+	f.Locked[userID] = true
+	return nil
+}
+
+// Unlock marks the wallet of the user unlocked
+func (f *Fake) Unlock(ctx context.Context, userID uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin("unlock"); err != nil {
+		return err
+	}
+	delete(f.Locked, userID)
+	return nil
+}
+
+// begin records a call and returns the configured error. It is called with the lock held.
+func (f *Fake) begin(op string) error {
+	f.Calls = append(f.Calls, op)
+	return f.Err
+}